@@ -0,0 +1,166 @@
+package tparagen
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+)
+
+// bddFramework is a BDD framework whose specs are run from a single test function.
+type bddFramework struct {
+	name string
+	// bootstraps are the functions that run the specs or hook the framework into the test.
+	bootstraps []string
+}
+
+// bddFrameworks are the BDD frameworks by import path. Their test functions must not call
+// t.Parallel(): the specs share the state of the framework and are parallelised by its own runner.
+var bddFrameworks = map[string]bddFramework{
+	"github.com/onsi/ginkgo": {
+		name:       "Ginkgo",
+		bootstraps: []string{"RunSpecs", "RunSpecsWithDefaultAndCustomReporters", "RunSpecsWithCustomReporters"},
+	},
+	"github.com/onsi/ginkgo/v2": {name: "Ginkgo", bootstraps: []string{"RunSpecs"}},
+	"github.com/onsi/gomega":    {name: "Gomega", bootstraps: []string{"RegisterFailHandler", "RegisterTestingT"}},
+	"github.com/franela/goblin": {name: "Goblin", bootstraps: []string{"Goblin"}},
+	"github.com/cucumber/godog": {name: "godog", bootstraps: []string{"TestSuite.Run"}},
+}
+
+// bddBootstrap is a call bootstrapping a BDD framework in a test function.
+type bddBootstrap struct {
+	pos       token.Pos
+	framework string
+	call      string
+}
+
+// findBDDBootstrap returns the first call in body bootstrapping a BDD framework, if any.
+func (s *pkgScope) findBDDBootstrap(body *ast.BlockStmt) (bddBootstrap, bool) {
+	var (
+		found bddBootstrap
+		ok    bool
+	)
+
+	ast.Inspect(body, func(n ast.Node) bool {
+		if ok {
+			return false
+		}
+
+		call, isCall := n.(*ast.CallExpr)
+		if !isCall {
+			return true
+		}
+
+		p, name, isBootstrap := s.bddCall(call)
+		if !isBootstrap {
+			return true
+		}
+
+		fw := bddFrameworks[p]
+		found, ok = bddBootstrap{pos: call.Pos(), framework: fw.name, call: name}, true
+
+		return false
+	})
+
+	return found, ok
+}
+
+// bddCall returns the import path of the BDD framework and the name of the function
+// bootstrapping it, if call calls one. The name of a method is qualified by its type.
+func (s *pkgScope) bddCall(call *ast.CallExpr) (string, string, bool) {
+	switch fun := call.Fun.(type) {
+	case *ast.Ident:
+		// RunSpecs(t, "Suite") with the framework dot-imported.
+		if fun.Obj != nil {
+			return "", "", false
+		}
+
+		for _, p := range s.fileOf(fun.Pos()).dotImports {
+			if containsBootstrap(p, fun.Name) {
+				return p, fun.Name, true
+			}
+		}
+	case *ast.SelectorExpr:
+		if x, ok := fun.X.(*ast.Ident); ok {
+			if p, ok := s.importedPkg(x); ok && containsBootstrap(p, fun.Sel.Name) {
+				return p, fun.Sel.Name, true
+			}
+		}
+
+		// godog.TestSuite{...}.Run(), or suite.Run() with suite := godog.TestSuite{...}
+		if sel, ok := valueType(fun.X).(*ast.SelectorExpr); ok {
+			if id, ok := sel.X.(*ast.Ident); ok {
+				name := sel.Sel.Name + "." + fun.Sel.Name
+				if p, ok := s.importedPkg(id); ok && containsBootstrap(p, name) {
+					return p, name, true
+				}
+			}
+		}
+	}
+
+	return "", "", false
+}
+
+// valueType returns the type of x if it is a composite literal, or a local variable
+// declared with a type or initialised with a composite literal.
+func valueType(x ast.Expr) ast.Expr {
+	switch x := ast.Unparen(x).(type) {
+	case *ast.CompositeLit:
+		return x.Type
+	case *ast.UnaryExpr:
+		if x.Op == token.AND {
+			return valueType(x.X)
+		}
+	case *ast.Ident:
+		if x.Obj == nil || x.Obj.Kind != ast.Var {
+			return nil
+		}
+
+		switch decl := x.Obj.Decl.(type) {
+		case *ast.AssignStmt:
+			for i, lhs := range decl.Lhs {
+				if id, ok := lhs.(*ast.Ident); ok && id.Name == x.Name && len(decl.Rhs) == len(decl.Lhs) {
+					return valueType(decl.Rhs[i])
+				}
+			}
+		case *ast.ValueSpec:
+			if decl.Type != nil {
+				return decl.Type
+			}
+
+			for i, name := range decl.Names {
+				if name.Name == x.Name && len(decl.Values) == len(decl.Names) {
+					return valueType(decl.Values[i])
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func containsBootstrap(importPath, name string) bool {
+	fw, ok := bddFrameworks[importPath]
+	if !ok {
+		return false
+	}
+
+	for _, b := range fw.bootstraps {
+		if b == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (b bddBootstrap) message() string {
+	return fmt.Sprintf("bootstraps %s with %s", b.framework, b.call)
+}
+
+// WithInsertIntoBDDSuites makes GenerateTParallel parallelise the test functions bootstrapping
+// BDD frameworks such as Ginkgo anyway. They are still reported.
+func WithInsertIntoBDDSuites() GenerateOption {
+	return func(o *generateOptions) {
+		o.insertIntoBDDSuites = true
+	}
+}
@@ -0,0 +1,326 @@
+package tparagen
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"go/token"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+)
+
+// insertion identifies a Parallel() insertion proposed by GenerateTParallel
+// by its test file and its index among the Parallel() insertions of the file.
+type insertion struct {
+	path  string
+	index int
+	edit  Edit
+}
+
+// Bisect finds the Parallel() insertions proposed for the package in dir that make
+// its tests fail, by running go test -race with subsets of the insertions applied through
+// an overlay. The test functions and subtests they are inserted into must stay serial, so
+// the opt-out directive is added to them; running tparagen afterwards parallelises the rest safely.
+func Bisect(ctx context.Context, outStream, errStream io.Writer, dir string, minGoVersion float64, opts ...Option) error {
+	return newTparagen(outStream, errStream, minGoVersion, opts...).bisect(ctx, dir)
+}
+
+func (t *tparagen) bisect(ctx context.Context, dir string) error {
+	b, err := t.newBisector(dir)
+	if err != nil {
+		return err
+	}
+
+	if len(b.insertions) == 0 {
+		fmt.Fprintf(t.outStream, "bisect: no insertions proposed for %s\n", dir)
+
+		return nil
+	}
+
+	passed, out, err := b.test(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if !passed {
+		return fmt.Errorf("tests of %s fail without any insertion.\n%s", dir, out)
+	}
+
+	serial, err := b.bisect(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(serial) == 0 {
+		fmt.Fprintf(t.outStream, "bisect: tests of %s pass with all %d insertions\n", dir, len(b.insertions))
+
+		return nil
+	}
+
+	for _, in := range serial {
+		target := in.edit.Func
+		if in.edit.Subtest != "" {
+			target = fmt.Sprintf("subtest %s of %s", in.edit.Subtest, in.edit.Func)
+		}
+
+		fmt.Fprintf(t.outStream, "bisect: %s:%d: %s must stay serial\n", in.path, in.edit.Pos.Line, target)
+	}
+
+	return b.optOut(serial)
+}
+
+// bisector narrows down the insertions that make the tests of a package fail.
+type bisector struct {
+	t   *tparagen
+	dir string
+	// srcs are the contents of the test files of the package keyed by their paths.
+	srcs       map[string][]byte
+	insertions []insertion
+}
+
+func (t *tparagen) newBisector(dir string) (*bisector, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*_test.go"))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no test files in %s", dir)
+	}
+
+	sort.Strings(paths)
+
+	b := &bisector{t: t, dir: dir, srcs: map[string][]byte{}}
+
+	for _, p := range paths {
+		src, err := os.ReadFile(p)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read %s. %w", p, err)
+		}
+
+		b.srcs[p] = src
+
+		var index int
+		if _, err := b.generate(p, src, func(e Edit) Decision {
+			if e.Kind == EditParallel {
+				b.insertions = append(b.insertions, insertion{path: p, index: index, edit: e})
+				index++
+			}
+
+			return Accept
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	return b, nil
+}
+
+// bisect returns the insertions to be left out for the tests to pass.
+// Each round finds the shortest prefix of the enabled insertions that makes the tests
+// fail; its last insertion is left out, until the tests pass with the rest.
+func (b *bisector) bisect(ctx context.Context) ([]insertion, error) {
+	enabled := append([]insertion{}, b.insertions...)
+
+	var serial []insertion
+
+	for {
+		passed, _, err := b.test(ctx, enabled)
+		if err != nil {
+			return nil, err
+		}
+
+		if passed {
+			return serial, nil
+		}
+
+		// The tests pass with enabled[:lo] and fail with enabled[:hi].
+		lo, hi := 0, len(enabled)
+		for hi-lo > 1 {
+			mid := (lo + hi) / 2
+
+			passed, _, err := b.test(ctx, enabled[:mid])
+			if err != nil {
+				return nil, err
+			}
+
+			if passed {
+				lo = mid
+			} else {
+				hi = mid
+			}
+		}
+
+		serial = append(serial, enabled[hi-1])
+		enabled = append(enabled[:hi-1:hi-1], enabled[hi:]...)
+	}
+}
+
+// test runs the tests of the package with the given insertions applied, and reports
+// whether they passed together with the output of go test. The other edits, such as the
+// copies of loop variables, are applied to the test functions with insertions applied, so
+// that the tests run without any insertion are the original ones.
+func (b *bisector) test(ctx context.Context, enabled []insertion) (bool, []byte, error) {
+	scratch, err := os.MkdirTemp("", "tparagen-bisect-")
+	if err != nil {
+		return false, nil, fmt.Errorf("failed to create scratch directory. %w", err)
+	}
+	defer os.RemoveAll(scratch)
+
+	ov := overlay{Replace: map[string]string{}}
+
+	for p := range b.srcs {
+		var index int
+
+		got, err := b.generate(p, b.srcs[p], func(e Edit) Decision {
+			if e.Kind != EditParallel {
+				for _, in := range enabled {
+					if in.path == p && in.edit.Func == e.Func {
+						return Accept
+					}
+				}
+
+				return Skip
+			}
+
+			defer func() { index++ }()
+
+			for _, in := range enabled {
+				if in.path == p && in.index == index {
+					return Accept
+				}
+			}
+
+			return Skip
+		})
+		if err != nil {
+			return false, nil, err
+		}
+
+		from, err := filepath.Abs(p)
+		if err != nil {
+			return false, nil, err
+		}
+
+		to := filepath.Join(scratch, filepath.Base(p))
+		if err := os.WriteFile(to, got, 0o644); err != nil {
+			return false, nil, fmt.Errorf("failed to write %s. %w", to, err)
+		}
+
+		ov.Replace[from] = to
+	}
+
+	out, err := goTestWithOverlay(ctx, b.dir, ov, b.t.verifyArgs()...)
+	if ctx.Err() != nil {
+		return false, nil, ctx.Err()
+	}
+
+	// A non-zero exit status means the tests failed; any other error means go test could not be run.
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return false, nil, fmt.Errorf("failed to run go test. %w", err)
+	}
+
+	return err == nil, out, nil
+}
+
+// optOut adds the opt-out directive to the test functions and subtests the insertions belong to.
+func (b *bisector) optOut(serial []insertion) error {
+	rewrites := newRewriteStore(b.t.pendingMemoryLimit)
+	defer rewrites.cleanup()
+
+	for p := range b.srcs {
+		funcs := map[string]bool{}
+		for _, in := range serial {
+			if in.path == p && in.edit.Subtest == "" {
+				funcs[in.edit.Func] = true
+			}
+		}
+
+		// The subtests of the functions staying serial as a whole stay serial with them.
+		var subtests []token.Position
+		for _, in := range serial {
+			if in.path == p && in.edit.Subtest != "" && !funcs[in.edit.Func] {
+				subtests = append(subtests, in.edit.SubtestPos)
+			}
+		}
+
+		if len(funcs) == 0 && len(subtests) == 0 {
+			continue
+		}
+
+		got := optOutSubtests(b.srcs[p], subtests)
+
+		if len(funcs) > 0 {
+			var err error
+			if got, err = b.generate(p, got, func(e Edit) Decision {
+				if funcs[e.Func] {
+					return OptOut
+				}
+
+				return Skip
+			}); err != nil {
+				return err
+			}
+		}
+
+		info, err := os.Stat(p)
+		if err != nil {
+			return fmt.Errorf("cannot stat %s. %w", p, err)
+		}
+
+		if err := rewrites.add(p, info, got); err != nil {
+			return err
+		}
+	}
+
+	pending, err := rewrites.stage()
+	if err != nil {
+		return err
+	}
+
+	return b.t.apply(pending)
+}
+
+// optOutSubtests adds the opt-out directive to src above the lines of the t.Run calls at the
+// given positions, with the indentation of the lines.
+func optOutSubtests(src []byte, runs []token.Position) []byte {
+	lineStarts := map[int]bool{}
+	for _, pos := range runs {
+		lineStarts[pos.Offset-(pos.Column-1)] = true
+	}
+
+	var out bytes.Buffer
+
+	for i := range src {
+		if (i == 0 || src[i-1] == '\n') && lineStarts[i] {
+			indent := src[i:]
+			indent = indent[:len(indent)-len(bytes.TrimLeft(indent, " \t"))]
+
+			out.Write(indent)
+			out.WriteString(optOutDirective + "\n")
+		}
+
+		out.WriteByte(src[i])
+	}
+
+	return out.Bytes()
+}
+
+func (b *bisector) generate(path string, src []byte, filter func(Edit) Decision) ([]byte, error) {
+	opts, err := b.t.generateOptions(target{path: path})
+	if err != nil {
+		return nil, err
+	}
+
+	got, err := GenerateTParallel(path, src, b.t.needFixLoopVar, append(opts, WithEditFilter(filter))...)
+	if err != nil {
+		return nil, fmt.Errorf("error occurred in Process(). %w", err)
+	}
+
+	return got, nil
+}
@@ -0,0 +1,137 @@
+package tparagen
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBisect(t *testing.T) {
+	t.Parallel()
+
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command is not available")
+	}
+
+	dir := t.TempDir()
+	fineTestSrc := strings.ReplaceAll(rewritableTestSrc, "package t", "package bad")
+	files := map[string]string{
+		"go.mod":       "module example.com/m\n\ngo 1.22\n",
+		"bad_test.go":  serialOnlyTestSrc,
+		"fine_test.go": fineTestSrc,
+	}
+	for name, src := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0o644); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+	}
+
+	var out strings.Builder
+
+	r := newRunner(dir)
+	r.outStream = &out
+	r.verifyCount = 1
+	r.verifyNoRace = true
+
+	if err := r.bisect(context.Background(), dir); err != nil {
+		t.Fatalf("bisect() returned error: %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(dir, "bad_test.go"))
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+
+	// Only the subtest at fault stays serial.
+	want := strings.Replace(serialOnlyTestSrc, "\tt.Run(\"1\"", "\t"+optOutDirective+"\n\tt.Run(\"1\"", 1)
+	if string(got) != want {
+		t.Errorf("result:\n%s, want:\n%s", got, want)
+	}
+
+	got, err = os.ReadFile(filepath.Join(dir, "fine_test.go"))
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+
+	if string(got) != fineTestSrc {
+		t.Errorf("expected the passing test file to be untouched, got:\n%s", got)
+	}
+
+	// Running tparagen afterwards parallelises the test function itself.
+	if err := newRunner(dir).run(context.Background()); err != nil {
+		t.Fatalf("run() returned error: %v", err)
+	}
+
+	if got, err = os.ReadFile(filepath.Join(dir, "bad_test.go")); err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+
+	want = strings.Replace(want, "func TestSerial(t *testing.T) {\n", "func TestSerial(t *testing.T) {\n\tt.Parallel()\n", 1)
+	if string(got) != want {
+		t.Errorf("result after run:\n%s, want:\n%s", got, want)
+	}
+
+	if !strings.Contains(out.String(), `subtest "1" of TestSerial must stay serial`) {
+		t.Errorf("expected the serial subtest to be reported, got:\n%s", out.String())
+	}
+}
+
+// deferOrderTestSrc is a test that fails once its defer statement is replaced with t.Cleanup().
+const deferOrderTestSrc = `package order
+
+import "testing"
+
+func TestOrder(t *testing.T) {
+	srv := "open"
+	defer func() { srv = "closed" }()
+	t.Run("1", func(t *testing.T) {
+		_ = srv
+	})
+	t.Cleanup(func() {
+		if srv != "closed" {
+			t.Error("the deferred function did not run first")
+		}
+	})
+}
+`
+
+func TestBisectWithReplacedDefer(t *testing.T) {
+	t.Parallel()
+
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command is not available")
+	}
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"go.mod":        "module example.com/m\n\ngo 1.22\n",
+		"order_test.go": deferOrderTestSrc,
+	}
+	for name, src := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0o644); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+	}
+
+	r := newRunner(dir)
+	r.verifyCount = 1
+	r.verifyNoRace = true
+
+	// The defer statement is only replaced along with the insertion into the subtest, which is at fault.
+	if err := r.bisect(context.Background(), dir); err != nil {
+		t.Fatalf("bisect() returned error: %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(dir, "order_test.go"))
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+
+	want := strings.Replace(deferOrderTestSrc, "\tt.Run(\"1\"", "\t"+optOutDirective+"\n\tt.Run(\"1\"", 1)
+	if string(got) != want {
+		t.Errorf("result:\n%s, want:\n%s", got, want)
+	}
+}
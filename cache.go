@@ -0,0 +1,293 @@
+package tparagen
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// cacheDirName is the directory under the user cache directory where results are cached.
+const cacheDirName = "tparagen"
+
+// resultCache records the test files that need no change, so that they are not
+// parsed and formatted again on the next run.
+// Entries are keyed by the file contents, the tparagen version and the effective options,
+// and, when the imported packages are type-checked, their sources.
+// A nil *resultCache is valid and caches nothing.
+type resultCache struct {
+	dir string
+	// deps caches the digests of the dependencies of the directories for the run.
+	// key: the directory and the import paths, value: func() (string, error)
+	deps sync.Map
+}
+
+// defaultCacheDir returns the directory for the cache under the user cache directory.
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(dir, cacheDirName)
+}
+
+func newResultCache(dir string) *resultCache {
+	if dir == "" {
+		return nil
+	}
+
+	return &resultCache{dir: dir}
+}
+
+// key returns the cache key of processing src, the contents of path, with the given options.
+// It reports false if the key cannot be computed, in which case the file is not cached.
+func (c *resultCache) key(path string, src []byte, needFixLoopVar bool, o *generateOptions) (string, bool) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%t\x00%s\x00", version(), needFixLoopVar, o.fingerprint())
+
+	// The sources of the imported packages decide the methods called and the parallel helpers.
+	if o.resolvesImports() {
+		deps, err := c.dependencyDigest(filepath.Dir(path), append([][]byte{src}, slices.Collect(maps.Values(o.packageFiles))...))
+		if err != nil {
+			return "", false
+		}
+
+		fmt.Fprintf(h, "%s\x00", deps)
+	}
+
+	h.Write(src)
+
+	return hex.EncodeToString(h.Sum(nil)), true
+}
+
+// resolvesImports reports whether GenerateTParallel may type-check the imported packages from source.
+func (o *generateOptions) resolvesImports() bool {
+	return o.detectParallelHelpers || len(o.incompatibleFuncs) > 0 || len(o.parallelHelpers) > 0 || o.parallelCall != ""
+}
+
+// dependencyDigest returns a digest of the sources of the packages imported by srcs, files of dir,
+// and of their dependencies, resolved with go list as the source importer does.
+// The standard library is identified by its root directory.
+func (c *resultCache) dependencyDigest(dir string, srcs [][]byte) (string, error) {
+	imports := map[string]bool{}
+
+	for _, src := range srcs {
+		f, err := parser.ParseFile(token.NewFileSet(), "", src, parser.ImportsOnly)
+		if err != nil {
+			continue
+		}
+
+		for _, spec := range f.Imports {
+			if p, err := strconv.Unquote(spec.Path.Value); err == nil && p != "C" {
+				imports[p] = true
+			}
+		}
+	}
+
+	paths := slices.Sorted(maps.Keys(imports))
+	if len(paths) == 0 {
+		return "", nil
+	}
+
+	v, _ := c.deps.LoadOrStore(dir+"\x00"+strings.Join(paths, "\x00"), sync.OnceValues(func() (string, error) {
+		return listedSourcesDigest(dir, paths)
+	}))
+
+	digest, _ := v.(func() (string, error))
+
+	return digest()
+}
+
+func listedSourcesDigest(dir string, paths []string) (string, error) {
+	const format = `{{if .Standard}}{{.Root}}{{else}}{{.Dir}}{{range .GoFiles}}{{"\t"}}{{.}}{{end}}{{end}}`
+
+	var stderr bytes.Buffer
+
+	cmd := exec.CommandContext(context.Background(), "go", append([]string{"list", "-e", "-deps", "-f", format, "--"}, paths...)...)
+	cmd.Dir = dir
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("go list failed. %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	h := sha256.New()
+
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Split(line, "\t")
+		fmt.Fprintf(h, "%s\x00", fields[0])
+
+		for _, name := range fields[1:] {
+			f, err := os.Open(filepath.Join(fields[0], name))
+			if err != nil {
+				return "", err
+			}
+
+			fmt.Fprintf(h, "%s\x00", name)
+			_, err = io.Copy(h, f)
+			f.Close()
+
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fingerprint returns a string identifying the effective options. It is a part of the cache key.
+// It covers all the fields, except those tagged fingerprint:"-", which only receive the results;
+// of the functions, it covers whether they are set.
+func (o *generateOptions) fingerprint() string {
+	h := sha256.New()
+	writeFingerprint(h, reflect.ValueOf(o).Elem())
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// writeFingerprint writes a representation of v to w that does not depend on
+// the addresses of the values or the order of the map keys.
+func writeFingerprint(w io.Writer, v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Func:
+		fmt.Fprintf(w, "func(%t)", !v.IsNil())
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			fmt.Fprint(w, "nil")
+
+			return
+		}
+
+		fmt.Fprintf(w, "%s(", v.Elem().Type())
+		writeFingerprint(w, v.Elem())
+		fmt.Fprint(w, ")")
+	case reflect.Struct:
+		fmt.Fprint(w, "{")
+
+		for i := range v.NumField() {
+			field := v.Type().Field(i)
+			if field.Tag.Get("fingerprint") == "-" {
+				continue
+			}
+
+			fmt.Fprintf(w, "%s:", field.Name)
+			writeFingerprint(w, v.Field(i))
+			fmt.Fprint(w, ",")
+		}
+
+		fmt.Fprint(w, "}")
+	case reflect.Slice, reflect.Array:
+		fmt.Fprintf(w, "[%d:", v.Len())
+
+		// e.g. the contents of the package files.
+		if v.Type().Elem().Kind() == reflect.Uint8 && v.Kind() == reflect.Slice {
+			w.Write(v.Bytes())
+			fmt.Fprint(w, "]")
+
+			return
+		}
+
+		for i := range v.Len() {
+			writeFingerprint(w, v.Index(i))
+			fmt.Fprint(w, ",")
+		}
+
+		fmt.Fprint(w, "]")
+	case reflect.Map:
+		keys := v.MapKeys()
+		slices.SortFunc(keys, func(a, b reflect.Value) int {
+			return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+		})
+
+		fmt.Fprintf(w, "map[%d:", len(keys))
+
+		for _, k := range keys {
+			writeFingerprint(w, k)
+			fmt.Fprint(w, ":")
+			writeFingerprint(w, v.MapIndex(k))
+			fmt.Fprint(w, ",")
+		}
+
+		fmt.Fprint(w, "]")
+	default:
+		fmt.Fprintf(w, "%#v", v)
+	}
+}
+
+// unchanged reports whether the contents for key are recorded as needing no change.
+func (c *resultCache) unchanged(key string) bool {
+	if c == nil {
+		return false
+	}
+
+	_, err := os.Stat(c.path(key))
+
+	return err == nil
+}
+
+// markUnchanged records that the contents for key need no change.
+// The cache is best-effort, so failures to write it are ignored.
+func (c *resultCache) markUnchanged(key string) {
+	if c == nil {
+		return
+	}
+
+	p := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return
+	}
+
+	_ = os.WriteFile(p, nil, 0o644)
+}
+
+func (c *resultCache) path(key string) string {
+	return filepath.Join(c.dir, key[:2], key)
+}
+
+var version = sync.OnceValue(func() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+
+	v := info.Main.Version
+
+	var modified bool
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			v += "+" + s.Value
+		case "vcs.modified":
+			modified = s.Value == "true"
+		}
+	}
+
+	// A build from a modified working tree changes without its version changing,
+	// so tell builds apart by the executable instead.
+	if modified {
+		if exe, err := os.Executable(); err == nil {
+			if fi, err := os.Stat(exe); err == nil {
+				v += fmt.Sprintf("+%d", fi.ModTime().UnixNano())
+			}
+		}
+	}
+
+	return v
+})
@@ -0,0 +1,172 @@
+package tparagen
+
+import (
+	"context"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRunRecordsUnchangedFilesInCache(t *testing.T) {
+	t.Parallel()
+
+	path, _ := setupTestModule(t)
+
+	r := newRunner(filepath.Dir(path))
+	r.cacheDir = t.TempDir()
+
+	// The first run rewrites the file; the second one finds nothing to change and records it.
+	for range 2 {
+		if err := r.run(context.Background()); err != nil {
+			t.Fatalf("run() returned error: %v", err)
+		}
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+
+	cache := newResultCache(r.cacheDir)
+	if key, _ := cache.key(path, b, r.needFixLoopVar, newGenerateOptions()); !cache.unchanged(key) {
+		t.Fatal("expected the rewritten file to be recorded as unchanged")
+	}
+}
+
+func TestRunSkipsCachedFiles(t *testing.T) {
+	t.Parallel()
+
+	path, orig := setupTestModule(t)
+
+	r := newRunner(filepath.Dir(path))
+	r.cacheDir = t.TempDir()
+
+	cache := newResultCache(r.cacheDir)
+	key, _ := cache.key(path, orig, r.needFixLoopVar, newGenerateOptions())
+	cache.markUnchanged(key)
+
+	if err := r.run(context.Background()); err != nil {
+		t.Fatalf("run() returned error: %v", err)
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+
+	if string(got) != string(orig) {
+		t.Fatalf("expected the cached file to be skipped.\norig:\n%s\ngot:\n%s", orig, got)
+	}
+}
+
+func TestFingerprintCoversAllOptions(t *testing.T) {
+	t.Parallel()
+
+	base := newGenerateOptions().fingerprint()
+
+	typ := reflect.TypeOf(generateOptions{})
+	for i := range typ.NumField() {
+		field := typ.Field(i)
+		if field.Tag.Get("fingerprint") == "-" {
+			continue
+		}
+
+		var o generateOptions
+
+		v := reflect.ValueOf(&o).Elem().Field(i)
+		v = reflect.NewAt(v.Type(), v.Addr().UnsafePointer()).Elem()
+
+		switch v.Kind() {
+		case reflect.Bool:
+			v.SetBool(true)
+		case reflect.String:
+			v.SetString("x")
+		case reflect.Func:
+			v.Set(reflect.MakeFunc(v.Type(), func([]reflect.Value) []reflect.Value {
+				return nil
+			}))
+		case reflect.Slice:
+			v.Set(reflect.MakeSlice(v.Type(), 1, 1))
+		case reflect.Map:
+			v.Set(reflect.MakeMap(v.Type()))
+			v.SetMapIndex(reflect.New(v.Type().Key()).Elem(), reflect.New(v.Type().Elem()).Elem())
+		default:
+			t.Fatalf("no value to test field %s of kind %s", field.Name, v.Kind())
+		}
+
+		if o.fingerprint() == base {
+			t.Errorf("expected field %s to change the fingerprint", field.Name)
+		}
+	}
+
+	files := map[string][]byte{"a.go": []byte("package a"), "b.go": []byte("package a")}
+	if newGenerateOptions(WithPackageFiles(files)).fingerprint() != newGenerateOptions(WithPackageFiles(maps.Clone(files))).fingerprint() {
+		t.Error("expected the fingerprint not to depend on the order of the package files")
+	}
+
+	if newGenerateOptions(WithPackageFiles(map[string][]byte{})).fingerprint() != base {
+		t.Error("expected no package files to have the fingerprint of no options")
+	}
+}
+
+func TestCacheKeyCoversImportedSources(t *testing.T) {
+	t.Parallel()
+
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command is not available")
+	}
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"go.mod":             "module example.com/m\n\ngo 1.22\n",
+		"testutil/helper.go": "package testutil\n\nimport \"testing\"\n\nfunc Setup(t *testing.T) {}\n",
+		"foo/foo_test.go":    "package foo\n\nimport (\n\t\"testing\"\n\n\t\"example.com/m/testutil\"\n)\n\nfunc TestFoo(t *testing.T) {\n\ttestutil.Setup(t)\n}\n",
+	}
+	for name, src := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatalf("failed to create dir: %v", err)
+		}
+
+		if err := os.WriteFile(p, []byte(src), 0o644); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+	}
+
+	path := filepath.Join(dir, "foo", "foo_test.go")
+	src := []byte(files["foo/foo_test.go"])
+	o := newGenerateOptions(WithParallelHelperDetection())
+
+	key, ok := newResultCache(t.TempDir()).key(path, src, false, o)
+	if !ok {
+		t.Fatal("expected the key to be computed")
+	}
+
+	// The helper now calls Parallel, which changes the result of processing foo_test.go.
+	helper := "package testutil\n\nimport \"testing\"\n\nfunc Setup(t *testing.T) {\n\tt.Parallel()\n}\n"
+	if err := os.WriteFile(filepath.Join(dir, "testutil", "helper.go"), []byte(helper), 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	got, ok := newResultCache(t.TempDir()).key(path, src, false, o)
+	if !ok {
+		t.Fatal("expected the key to be computed")
+	}
+
+	if got == key {
+		t.Error("expected a change of an imported package to change the key")
+	}
+
+	// Without type-checking, the imported packages do not matter.
+	k1, _ := newResultCache(t.TempDir()).key(path, src, false, newGenerateOptions())
+	if err := os.WriteFile(filepath.Join(dir, "testutil", "helper.go"), []byte(files["testutil/helper.go"]), 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	if k2, _ := newResultCache(t.TempDir()).key(path, src, false, newGenerateOptions()); k1 != k2 {
+		t.Error("expected the key not to depend on the imported packages without type-checking")
+	}
+}
@@ -0,0 +1,550 @@
+package tparagen
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/tools/go/ast/astutil"
+)
+
+// parallelSubtest is a subtest GenerateTParallel inserted Parallel() into.
+type parallelSubtest struct {
+	// run is the call registering the subtest.
+	run *ast.CallExpr
+	// fun is the callback of the subtest, the argument of run or a function of a table.
+	fun *ast.FuncLit
+}
+
+// capture is a use, by the parallel subtests of a function, of local state the function
+// releases or changes before they run. Parallel subtests only run after the function returns.
+type capture struct {
+	pos     token.Pos
+	message string
+	// deferStmt is the statement releasing the state, which t.Cleanup can replace.
+	deferStmt *ast.DeferStmt
+}
+
+// WithParentDefersKept makes GenerateTParallel leave as is the defer statements of a test that release
+// the state used by the subtests it parallelises, such as defer srv.Close(), and only report them.
+// By default, they are replaced with t.Cleanup(), as the deferred calls would run before the subtests.
+func WithParentDefersKept() GenerateOption {
+	return func(o *generateOptions) {
+		o.keepParentDefers = true
+	}
+}
+
+// findCaptures returns the uses by subtests, the parallel subtests registered in body, of the
+// local variables that body releases with a defer statement, or changes after registering them,
+// including with a range loop assigning with =.
+func (s *pkgScope) findCaptures(body *ast.BlockStmt, subtests []parallelSubtest) []capture {
+	var captures []capture
+
+	// The defer statements and the writes outside the subtests, with the loops enclosing them.
+	var loops []ast.Node
+
+	var inspect func(n ast.Node) bool
+	inspect = func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.RangeStmt, *ast.ForStmt:
+			loops = append(loops, n)
+
+			if r, ok := n.(*ast.RangeStmt); ok && r.Tok == token.ASSIGN {
+				for _, expr := range []ast.Expr{r.Key, r.Value} {
+					if expr == nil {
+						continue
+					}
+
+					if c, ok := s.writeCapture(expr, r, loops, subtests); ok {
+						captures = append(captures, c)
+					}
+				}
+			}
+
+			ast.Inspect(loopBody(n), inspect)
+			loops = loops[:len(loops)-1]
+
+			return false
+		case *ast.DeferStmt:
+			if c, ok := s.deferCapture(n, subtests); ok {
+				captures = append(captures, c)
+			}
+		case *ast.AssignStmt:
+			for _, lhs := range n.Lhs {
+				if c, ok := s.writeCapture(lhs, n, loops, subtests); ok {
+					captures = append(captures, c)
+				}
+			}
+		case *ast.IncDecStmt:
+			if c, ok := s.writeCapture(n.X, n, loops, subtests); ok {
+				captures = append(captures, c)
+			}
+		}
+
+		return true
+	}
+
+	ast.Inspect(body, inspect)
+
+	return captures
+}
+
+// deferCapture returns a capture if the call deferred by d refers to a variable, or one declared
+// along with it such as ctx in ctx, cancel := context.WithCancel(ctx), used by any of subtests.
+func (s *pkgScope) deferCapture(d *ast.DeferStmt, subtests []parallelSubtest) (capture, bool) {
+	released := s.releasedVars(d)
+
+	for _, st := range subtests {
+		if v, ok := capturedVar(st.fun, released); ok {
+			return capture{
+				pos:       d.Pos(),
+				message:   fmt.Sprintf("defers %s, which runs before the parallel subtests using %s; use t.Cleanup", nodeString(d.Call), v),
+				deferStmt: d,
+			}, true
+		}
+	}
+
+	return capture{}, false
+}
+
+// releasedVars returns the local variables the call deferred by d refers to, along with
+// those declared with them, such as ctx in ctx, cancel := context.WithCancel(ctx).
+func (s *pkgScope) releasedVars(d *ast.DeferStmt) map[*ast.Object]bool {
+	released := map[*ast.Object]bool{}
+
+	ast.Inspect(d.Call, func(n ast.Node) bool {
+		id, ok := n.(*ast.Ident)
+		if !ok || s.isGlobal(id) || id.Obj.Kind != ast.Var {
+			return true
+		}
+
+		released[id.Obj] = true
+
+		if assign, ok := id.Obj.Decl.(*ast.AssignStmt); ok {
+			for _, lhs := range assign.Lhs {
+				if l, ok := lhs.(*ast.Ident); ok && l.Obj != nil && l.Name != "_" {
+					released[l.Obj] = true
+				}
+			}
+		}
+
+		return true
+	})
+
+	return released
+}
+
+// writeCapture returns a capture if lhs, the target of stmt, is a local variable or a part of one
+// used by any of subtests, and stmt may run after the subtest is registered: after its Run call,
+// or in a loop enclosing it.
+func (s *pkgScope) writeCapture(lhs ast.Expr, stmt ast.Stmt, loops []ast.Node, subtests []parallelSubtest) (capture, bool) {
+	id, ok := rootIdent(lhs)
+	if !ok || s.isGlobal(id) || id.Obj.Kind != ast.Var {
+		return capture{}, false
+	}
+
+	// A declaration is not a write, unless it redeclares the variable, such as v, err := f().
+	if assign, ok := stmt.(*ast.AssignStmt); ok && assign.Tok == token.DEFINE && id.Obj.Decl == assign {
+		return capture{}, false
+	}
+
+	for _, st := range subtests {
+		if _, ok := capturedVar(st.fun, map[*ast.Object]bool{id.Obj: true}); !ok {
+			continue
+		}
+
+		after := stmt.Pos() > st.run.End()
+
+		for _, loop := range loops {
+			if loop.Pos() <= st.run.Pos() && st.run.End() <= loop.End() {
+				after = true
+			}
+		}
+
+		if after {
+			return capture{
+				pos:     stmt.Pos(),
+				message: fmt.Sprintf("changes %s, which its parallel subtests use, while they may run", id.Name),
+			}, true
+		}
+	}
+
+	return capture{}, false
+}
+
+// capturedVar returns the name of a variable of vars that fun refers to.
+func capturedVar(fun *ast.FuncLit, vars map[*ast.Object]bool) (string, bool) {
+	var name string
+
+	ast.Inspect(fun.Body, func(n ast.Node) bool {
+		if id, ok := n.(*ast.Ident); ok && id.Obj != nil && vars[id.Obj] {
+			name = id.Name
+		}
+
+		return name == ""
+	})
+
+	return name, name != ""
+}
+
+// rootIdent returns the variable expr is a part of, such as m in m[k] or s.items.
+func rootIdent(expr ast.Expr) (*ast.Ident, bool) {
+	for {
+		switch e := expr.(type) {
+		case *ast.Ident:
+			return e, e.Name != "_"
+		case *ast.SelectorExpr:
+			expr = e.X
+		case *ast.IndexExpr:
+			expr = e.X
+		case *ast.StarExpr:
+			expr = e.X
+		case *ast.ParenExpr:
+			expr = e.X
+		default:
+			return nil, false
+		}
+	}
+}
+
+func loopBody(loop ast.Node) *ast.BlockStmt {
+	if r, ok := loop.(*ast.RangeStmt); ok {
+		return r.Body
+	}
+
+	return loop.(*ast.ForStmt).Body
+}
+
+// checkCaptures replaces the defer statements releasing the state used by subtests, the subtests
+// made parallel in body, a part of decl, with t.Cleanup() unless keepParentDefers is set, testVar
+// being the *testing.T of body, and reports the other captures.
+func (o *generateOptions) checkCaptures(scope *pkgScope, f *ast.File, rv *reviewer, decl *ast.FuncDecl, body *ast.BlockStmt, testVar string, subtests []parallelSubtest) {
+	if len(subtests) == 0 {
+		return
+	}
+
+	captures := scope.findCaptures(body, subtests)
+
+	// The last defer statement to replace, in the order they are registered.
+	var last *ast.DeferStmt
+
+	for _, c := range captures {
+		if c.deferStmt != nil && !o.keepParentDefers && (last == nil || c.deferStmt.Pos() > last.Pos()) {
+			last = c.deferStmt
+		}
+	}
+
+	var replaced map[*ast.DeferStmt][]ast.Stmt
+	if last != nil {
+		replaced = scope.replaceDefers(f, rv, decl, body, testVar, last)
+	}
+
+	for _, c := range captures {
+		if c.deferStmt == nil || replaced[c.deferStmt] == nil {
+			o.report(scope.fs, c.pos, decl.Name.Name, CategoryCapturedState, c.message, false)
+		}
+	}
+
+	if len(replaced) == 0 {
+		return
+	}
+
+	astutil.Apply(body, func(c *astutil.Cursor) bool {
+		d, ok := c.Node().(*ast.DeferStmt)
+		if !ok || replaced[d] == nil {
+			return true
+		}
+
+		stmts := replaced[d]
+		if c.Index() < 0 {
+			// e.g. the statement of a labeled statement.
+			c.Replace(&ast.BlockStmt{List: stmts})
+
+			return false
+		}
+
+		for _, stmt := range stmts[:len(stmts)-1] {
+			c.InsertBefore(stmt)
+		}
+
+		c.Replace(stmts[len(stmts)-1])
+
+		return false
+	}, nil)
+}
+
+// replaceDefers returns the statements replacing the defer statements of body, a part of decl,
+// registered up to last, which are all replaced so that they still run in the reverse order:
+// the cleanup functions run after the deferred calls. It returns nil if any of them cannot be
+// replaced, calling recover(), or is not accepted.
+func (s *pkgScope) replaceDefers(f *ast.File, rv *reviewer, decl *ast.FuncDecl, body *ast.BlockStmt, testVar string, last *ast.DeferStmt) map[*ast.DeferStmt][]ast.Stmt {
+	var defers []*ast.DeferStmt
+
+	ast.Inspect(body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.DeferStmt:
+			if n.Pos() <= last.Pos() {
+				defers = append(defers, n)
+			}
+		}
+
+		return true
+	})
+
+	for _, d := range defers {
+		if callsRecover(d) {
+			return nil
+		}
+	}
+
+	names := s.usedNames(decl)
+	replaced := map[*ast.DeferStmt][]ast.Stmt{}
+
+	for _, d := range defers {
+		stmts := s.buildCleanupStmts(decl, d, testVar, names)
+		if !rv.accept(f, decl, EditDeferToCleanup, nil, d.Pos(), stmts[len(stmts)-1]) {
+			return nil
+		}
+
+		replaced[d] = stmts
+	}
+
+	return replaced
+}
+
+// buildCleanupStmts returns the statements registering the call deferred by d, a statement of decl,
+// with testVar.Cleanup(). The function value and the arguments, which the defer statement evaluates
+// when it runs, are copied to new variables there if they may evaluate differently later, such as
+// fClose := f.Close before t.Cleanup(func() { fClose() }) for defer f.Close() in a loop.
+func (s *pkgScope) buildCleanupStmts(decl *ast.FuncDecl, d *ast.DeferStmt, testVar string, names map[string]bool) []ast.Stmt {
+	pos := d.Pos()
+	call := *d.Call
+	call.Args = slices.Clone(call.Args)
+	base := deferredName(call.Fun)
+
+	var lhs, rhs []ast.Expr
+
+	copyExpr := func(e ast.Expr, name string) ast.Expr {
+		if !s.evaluatesLater(decl, d, e) {
+			return e
+		}
+
+		id := &ast.Ident{NamePos: pos, Name: freshName(names, name)}
+		lhs, rhs = append(lhs, id), append(rhs, e)
+
+		return &ast.Ident{NamePos: pos, Name: id.Name}
+	}
+
+	if _, ok := call.Fun.(*ast.FuncLit); !ok {
+		call.Fun = copyExpr(call.Fun, base)
+	}
+
+	for i, arg := range call.Args {
+		call.Args[i] = copyExpr(arg, base+"Arg")
+	}
+
+	cleanup := buildCleanupStmt(&ast.DeferStmt{Defer: d.Defer, Call: &call}, testVar)
+	if len(lhs) == 0 {
+		return []ast.Stmt{cleanup}
+	}
+
+	return []ast.Stmt{&ast.AssignStmt{Lhs: lhs, TokPos: pos, Tok: token.DEFINE, Rhs: rhs}, cleanup}
+}
+
+// evaluatesLater reports whether e, a part of the call deferred by d, a statement of decl, may
+// evaluate differently when the test finishes than at d: it calls a function, reads through a
+// pointer, an index or a channel, or refers to a local variable changed after d or in a loop.
+func (s *pkgScope) evaluatesLater(decl *ast.FuncDecl, d *ast.DeferStmt, e ast.Expr) bool {
+	inLoop := false
+
+	ast.Inspect(decl.Body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.ForStmt, *ast.RangeStmt:
+			if n.Pos() <= d.Pos() && d.End() <= n.End() {
+				inLoop = true
+			}
+		}
+
+		return !inLoop
+	})
+
+	var later bool
+
+	ast.Inspect(e, func(n ast.Node) bool {
+		if later {
+			return false
+		}
+
+		switch n := n.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.CallExpr, *ast.IndexExpr, *ast.IndexListExpr, *ast.StarExpr:
+			later = true
+		case *ast.UnaryExpr:
+			later = n.Op == token.ARROW
+		case *ast.Ident:
+			if !s.isGlobal(n) && n.Obj.Kind == ast.Var && (inLoop || changedAfter(decl.Body, n.Obj, d.End())) {
+				later = true
+			}
+		}
+
+		return !later
+	})
+
+	return later
+}
+
+// changedAfter reports whether body assigns to the variable obj, or a part of it, or takes its
+// address, after pos.
+func changedAfter(body *ast.BlockStmt, obj *ast.Object, pos token.Pos) bool {
+	var changed bool
+
+	is := func(e ast.Expr) bool {
+		id, ok := rootIdent(e)
+
+		return ok && id.Obj == obj && id.Pos() > pos
+	}
+
+	ast.Inspect(body, func(n ast.Node) bool {
+		if changed {
+			return false
+		}
+
+		switch n := n.(type) {
+		case *ast.AssignStmt:
+			changed = slices.ContainsFunc(n.Lhs, is)
+		case *ast.IncDecStmt:
+			changed = is(n.X)
+		case *ast.RangeStmt:
+			changed = n.Tok == token.ASSIGN && (n.Key != nil && is(n.Key) || n.Value != nil && is(n.Value))
+		case *ast.UnaryExpr:
+			changed = n.Op == token.AND && is(n.X)
+		}
+
+		return !changed
+	})
+
+	return changed
+}
+
+// usedNames returns the names decl refers to or declares, along with the package-level names,
+// which the new variables of decl must not shadow.
+func (s *pkgScope) usedNames(decl *ast.FuncDecl) map[string]bool {
+	names := maps.Clone(s.names)
+
+	ast.Inspect(decl, func(n ast.Node) bool {
+		if id, ok := n.(*ast.Ident); ok {
+			names[id.Name] = true
+		}
+
+		return true
+	})
+
+	return names
+}
+
+// freshName returns name, or name with the smallest number from 2 appended, that is not in names,
+// and adds it to names.
+func freshName(names map[string]bool, name string) string {
+	fresh := name
+	for i := 2; names[fresh]; i++ {
+		fresh = name + strconv.Itoa(i)
+	}
+
+	names[fresh] = true
+
+	return fresh
+}
+
+// deferredName returns the base of the names of the variables copying the function value fun
+// and its arguments, such as srvClose for srv.Close.
+func deferredName(fun ast.Expr) string {
+	var parts []string
+
+	for {
+		switch e := fun.(type) {
+		case *ast.Ident:
+			parts = append([]string{e.Name}, parts...)
+
+			name := parts[0]
+			for _, part := range parts[1:] {
+				name += strings.ToUpper(part[:1]) + part[1:]
+			}
+
+			if !token.IsIdentifier(name) {
+				return "deferred"
+			}
+
+			return name
+		case *ast.SelectorExpr:
+			parts = append([]string{e.Sel.Name}, parts...)
+			fun = e.X
+		default:
+			return "deferred"
+		}
+	}
+}
+
+// callsRecover reports whether the function deferred by d calls recover(), which only
+// stops a panic in a deferred function.
+func callsRecover(d *ast.DeferStmt) bool {
+	fun, ok := d.Call.Fun.(*ast.FuncLit)
+	if !ok {
+		return false
+	}
+
+	var found bool
+
+	ast.Inspect(fun.Body, func(n ast.Node) bool {
+		if call, ok := n.(*ast.CallExpr); ok {
+			if id, ok := call.Fun.(*ast.Ident); ok && id.Name == "recover" && id.Obj == nil {
+				found = true
+			}
+		}
+
+		return !found
+	})
+
+	return found
+}
+
+// buildCleanupStmt returns the statement registering the call deferred by d with testVar.Cleanup(),
+// such as t.Cleanup(func() { srv.Close() }) for defer srv.Close().
+func buildCleanupStmt(d *ast.DeferStmt, testVar string) *ast.ExprStmt {
+	pos := d.Pos()
+
+	// defer func() { ... }() registers the function literal itself.
+	fun, ok := d.Call.Fun.(*ast.FuncLit)
+	if !ok || len(d.Call.Args) != 0 {
+		fun = &ast.FuncLit{
+			Type: &ast.FuncType{Func: pos, Params: &ast.FieldList{}},
+			Body: &ast.BlockStmt{
+				Lbrace: pos,
+				List:   []ast.Stmt{&ast.ExprStmt{X: d.Call}},
+				Rbrace: d.Call.End(),
+			},
+		}
+	}
+
+	return &ast.ExprStmt{
+		X: &ast.CallExpr{
+			Fun: &ast.SelectorExpr{
+				X:   buildTestExpr(pos, testVar),
+				Sel: &ast.Ident{NamePos: pos, Name: "Cleanup"},
+			},
+			Lparen: pos,
+			Args:   []ast.Expr{fun},
+			Rparen: d.Call.End(),
+		},
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -14,22 +16,150 @@ import (
 )
 
 var (
+	minGoVersionSet bool
+
 	ignoreDirectories = kingpin.Flag("ignore", "ignore directory names. ex: foo,bar,baz\n(testdata directory is always ignored.)").String()
-	minGoVersion      = kingpin.Flag("min-go-version", "minimum go version").Default("1.21").Float64()
+	minGoVersion      = kingpin.Flag("min-go-version", "minimum go version\n(with --stdin or explain, defaults to the go directive of go.mod.)").Default("1.21").IsSetByUser(&minGoVersionSet).Float64()
+	stdin             = kingpin.Flag("stdin", "read a Go source from stdin and write the result to stdout.").Bool()
+	stdinFilename     = kingpin.Flag("stdin-filename", "with --stdin, the path of the source used in messages and to find go.mod.").String()
+	since             = kingpin.Flag("since", "only process test files changed since the git revision. ex: main").String()
+	staged            = kingpin.Flag("staged", "only process test files with changes staged in git.").Bool()
+	changedFuncs      = kingpin.Flag("changed-funcs", "with --since or --staged, only process the functions containing changed lines.").Bool()
+	sharedState       = kingpin.Flag("shared-state", "what to do with tests using shared state such as package-level variables or os.Chdir. skip or warn").Default("skip").Enum("skip", "warn")
+	bddSuites         = kingpin.Flag("bdd-suites", "what to do with tests bootstrapping BDD frameworks such as Ginkgo, whose specs are parallelised by their own runner. skip or insert").Default("skip").Enum("skip", "insert")
+	testMain          = kingpin.Flag("test-main", "what to do with the packages defining TestMain, which may set up fixtures shared by the tests. skip or process").Default("skip").Enum("skip", "process")
+	parentDefer       = kingpin.Flag("parent-defer", "what to do with the defer statements of tests releasing state, such as a server, used by the subtests made parallel, which run after them. cleanup, replacing them with t.Cleanup, or warn").Default("cleanup").Enum("cleanup", "warn")
+	groupSubtests     = kingpin.Flag("group-subtests", "wrap the loops registering the subtests made parallel in t.Run(\"group\", ...) when the test has defer statements or statements after them,\nso that they still run after the subtests.").Bool()
+	subtestResults    = kingpin.Flag("subtest-results", "what to do with the loops whose subtests write variables the test reads after the loop, such as collected results. skip or warn").Default("skip").Enum("skip", "warn")
+	incompatibleFuncs = kingpin.Flag("incompatible-func", "fully-qualified function or method that makes the tests calling it unable to run in parallel, like t.Setenv.\nrepeatable. ex: github.com/acme/testutil.SetGlobalClock, (*github.com/acme/dbtest.DB).Reset").Strings()
+	parallelHelpers   = kingpin.Flag("parallel-helper", "fully-qualified function or method that calls t.Parallel on its *testing.T argument, so that the tests calling it are already parallel.\nrepeatable. ex: github.com/acme/testutil.Parallel").Strings()
+	detectHelpers     = kingpin.Flag("detect-parallel-helpers", "also treat the functions calling Parallel unconditionally on their *testing.T argument as parallel helpers, using type information.").Bool()
+	parallelCall      = kingpin.Flag("parallel-call", "call of a package-level function to insert instead of t.Parallel(), where $t stands for the *testing.T variable.\nex: github.com/acme/testenv.Parallel($t)").String()
+	testify           = kingpin.Flag("testify", "also parallelise the methods of the test suites of github.com/stretchr/testify/suite, func (s *MySuite) TestXxx(), of the types embedding suite.Suite.\nthe methods share the suite and s.T() is swapped for each of them, so only use it for suites whose methods keep their state local.").Bool()
+	suiteTypes        = kingpin.Flag("suite-type", "name of a test-suite type whose methods TestXxx() or TestXxx(t *testing.T) are run as tests. in the former, the type embeds *testing.T.\nrepeatable.").Strings()
+	interactive       = kingpin.Flag("interactive", "ask whether to insert each statement.").Bool()
+	verify            = kingpin.Flag("verify", "run the tests of each package with go test -race before applying the rewrites,\nand only apply them to the packages whose tests pass.").Bool()
+	verifyCount       = kingpin.Flag("verify-count", "with --verify, the -count flag of go test.").Default("1").Int()
+	cache             = kingpin.Flag("cache", "skip the test files that needed no change on a previous run.").Default("true").Bool()
+	jobs              = kingpin.Flag("jobs", "number of test files processed concurrently. (defaults to the number of CPUs.)").Short('j').Default("0").Int()
+
+	_             = kingpin.Command("run", "insert t.Parallel() into the test files under the current directory.").Default()
+	bisectCmd     = kingpin.Command("bisect", "find the insertions that make the tests of a package fail,\nand add the opt-out directive to their test functions or subtests.")
+	bisectPackage = bisectCmd.Arg("package", "directory of the package.").Required().ExistingDir()
+	explainCmd    = kingpin.Command("explain", "print why each test and subtest of a test file is or is not parallelised, without changing it.")
+	explainTarget = explainCmd.Arg("file", "test file, optionally with a line to only explain the function containing it. ex: foo_test.go:42").Required().String()
 )
 
 func main() {
 	now := time.Now()
 
-	kingpin.Parse()
 	kingpin.HelpFlag.Short('h')
+	cmd := kingpin.Parse()
 
 	// Cancel the run gracefully on interruption (Ctrl+C) or termination (kill),
 	// so temporary files are cleaned up instead of being left behind.
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
-	if err := tparagen.Run(ctx, os.Stdout, os.Stderr, strings.Split(*ignoreDirectories, ","), *minGoVersion); err != nil {
+	opts := []tparagen.Option{tparagen.WithJobs(*jobs)}
+	if *since != "" {
+		opts = append(opts, tparagen.WithSince(*since))
+	}
+	if *staged {
+		opts = append(opts, tparagen.WithStaged())
+	}
+	if *changedFuncs {
+		opts = append(opts, tparagen.WithChangedFuncsOnly())
+	}
+	if *testMain == "process" {
+		opts = append(opts, tparagen.WithProcessTestMainPackages())
+	}
+	var genOpts []tparagen.GenerateOption
+	if *sharedState == "warn" {
+		genOpts = append(genOpts, tparagen.WithInsertDespiteHazards())
+	}
+	if *bddSuites == "insert" {
+		genOpts = append(genOpts, tparagen.WithInsertIntoBDDSuites())
+	}
+	if *parentDefer == "warn" {
+		genOpts = append(genOpts, tparagen.WithParentDefersKept())
+	}
+	if *groupSubtests {
+		genOpts = append(genOpts, tparagen.WithSubtestGroups())
+	}
+	if *subtestResults == "warn" {
+		genOpts = append(genOpts, tparagen.WithInsertDespiteSubtestResults())
+	}
+	if len(*incompatibleFuncs) != 0 {
+		genOpts = append(genOpts, tparagen.WithParallelIncompatibleFuncs(*incompatibleFuncs...))
+	}
+	if len(*parallelHelpers) != 0 {
+		genOpts = append(genOpts, tparagen.WithParallelHelpers(*parallelHelpers...))
+	}
+	if *detectHelpers {
+		genOpts = append(genOpts, tparagen.WithParallelHelperDetection())
+	}
+	if *parallelCall != "" {
+		genOpts = append(genOpts, tparagen.WithParallelCall(*parallelCall))
+	}
+	if *testify {
+		genOpts = append(genOpts, tparagen.WithTestFrameworks(tparagen.TestifySuite()))
+	}
+	for _, name := range *suiteTypes {
+		genOpts = append(genOpts, tparagen.WithTestFrameworks(tparagen.SuiteType(name)))
+	}
+	opts = append(opts, tparagen.WithGenerateOptions(genOpts...))
+	if *interactive {
+		opts = append(opts, tparagen.WithInteractive(os.Stdin))
+	}
+	if *verify {
+		opts = append(opts, tparagen.WithVerify(*verifyCount))
+	}
+	if !*cache {
+		opts = append(opts, tparagen.WithCacheDir(""))
+	}
+
+	if cmd == bisectCmd.FullCommand() {
+		if err := tparagen.Bisect(ctx, os.Stdout, os.Stderr, *bisectPackage, *minGoVersion, append(opts, tparagen.WithVerify(*verifyCount))...); err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	if cmd == explainCmd.FullCommand() {
+		path, line := parseExplainTarget(*explainTarget)
+		if !minGoVersionSet {
+			if v, ok := tparagen.ModuleGoVersion(filepath.Dir(path)); ok {
+				*minGoVersion = v
+			}
+		}
+
+		if err := tparagen.Explain(os.Stdout, path, line, *minGoVersion, opts...); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	if *stdin {
+		if !minGoVersionSet && *stdinFilename != "" {
+			if v, ok := tparagen.ModuleGoVersion(filepath.Dir(*stdinFilename)); ok {
+				*minGoVersion = v
+			}
+		}
+
+		if err := tparagen.Filter(os.Stdin, os.Stdout, *stdinFilename, *minGoVersion, opts...); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	if err := tparagen.Run(ctx, os.Stdout, os.Stderr, strings.Split(*ignoreDirectories, ","), *minGoVersion, opts...); err != nil {
 		fmt.Println(err.Error())
 		os.Exit(1)
 	}
@@ -40,3 +170,18 @@ func main() {
 		fmt.Printf("✨ Done in %ss\n", fmt.Sprintf("%.2f", time.Since(now).Seconds()))
 	}
 }
+
+// parseExplainTarget splits the argument of explain, file[:line], into the file and the line, 0 if absent.
+func parseExplainTarget(arg string) (string, int) {
+	i := strings.LastIndex(arg, ":")
+	if i < 0 {
+		return arg, 0
+	}
+
+	line, err := strconv.Atoi(arg[i+1:])
+	if err != nil || line < 1 {
+		return arg, 0
+	}
+
+	return arg[:i], line
+}
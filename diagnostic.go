@@ -0,0 +1,74 @@
+package tparagen
+
+import (
+	"fmt"
+	"go/token"
+)
+
+// Diagnostic categories.
+const (
+	// CategorySharedState is the category of tests using shared state, which are unsafe to run in parallel.
+	CategorySharedState = "shared-state"
+	// CategoryBDD is the category of tests bootstrapping BDD frameworks such as Ginkgo,
+	// whose specs are parallelised by the framework's own runner.
+	CategoryBDD = "bdd"
+	// CategorySerialPackage is the category of packages whose tests are all left serial,
+	// because of TestMain or the //tparagen:serial directive.
+	CategorySerialPackage = "serial-package"
+	// CategoryCapturedState is the category of tests whose parallel subtests use local state
+	// the test releases or changes before they run, such as a server closed by a defer statement.
+	CategoryCapturedState = "captured-state"
+	// CategorySubtestResult is the category of tests reading after a loop the variables its subtests
+	// write, such as collected results, which parallel subtests only write after the test returns.
+	CategorySubtestResult = "subtest-result"
+)
+
+// Diagnostic is a finding about a test function reported by GenerateTParallel.
+type Diagnostic struct {
+	Pos token.Position
+	// Func is the name of the test function concerned.
+	Func string
+	// Category is the kind of the finding, such as CategorySharedState.
+	Category string
+	Message  string
+	// Skipped reports whether the test function was left as is because of the finding.
+	Skipped bool
+}
+
+func (d Diagnostic) String() string {
+	s := fmt.Sprintf("%s: %s %s", d.Pos, d.Func, d.Message)
+	if d.Skipped {
+		s += ", not parallelised"
+	}
+
+	return s
+}
+
+// WithDiagnostics makes GenerateTParallel report its findings to f.
+func WithDiagnostics(f func(Diagnostic)) GenerateOption {
+	return func(o *generateOptions) {
+		o.diagnostics = f
+	}
+}
+
+// WithInsertDespiteHazards makes GenerateTParallel parallelise the tests using shared
+// state anyway. The uses of shared state are still reported.
+func WithInsertDespiteHazards() GenerateOption {
+	return func(o *generateOptions) {
+		o.insertDespiteHazards = true
+	}
+}
+
+func (o *generateOptions) report(fs *token.FileSet, pos token.Pos, funcName, category, message string, skipped bool) {
+	if o.diagnostics == nil {
+		return
+	}
+
+	o.diagnostics(Diagnostic{
+		Pos:      fs.Position(pos),
+		Func:     funcName,
+		Category: category,
+		Message:  message,
+		Skipped:  skipped,
+	})
+}
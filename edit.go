@@ -0,0 +1,278 @@
+package tparagen
+
+import (
+	"bytes"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"slices"
+	"strconv"
+
+	"golang.org/x/tools/go/ast/astutil"
+)
+
+// optOutDirective is the directive added to a test function to exclude it from tparagen.
+const optOutDirective = "//nolint:paralleltest"
+
+// EditKind is the kind of a statement inserted by GenerateTParallel.
+type EditKind int
+
+const (
+	// EditParallel inserts a call to Parallel() into a test or subtest.
+	EditParallel EditKind = iota
+	// EditLoopVarCopy inserts a copy of a loop variable captured by a subtest, such as tc := tc.
+	EditLoopVarCopy
+	// EditDeferToCleanup replaces a defer statement of a test with a call to Cleanup(),
+	// such as t.Cleanup(func() { srv.Close() }) for defer srv.Close().
+	EditDeferToCleanup
+	// EditGroup wraps a loop registering parallel subtests in a group subtest,
+	// such as t.Run("group", func(t *testing.T) { for ... }).
+	EditGroup
+)
+
+func (k EditKind) String() string {
+	switch k {
+	case EditParallel:
+		return "parallel"
+	case EditLoopVarCopy:
+		return "loop variable copy"
+	case EditDeferToCleanup:
+		return "defer to cleanup"
+	case EditGroup:
+		return "group"
+	default:
+		return "unknown"
+	}
+}
+
+// Edit is a statement GenerateTParallel proposes to insert, or to replace a statement with.
+type Edit struct {
+	Kind EditKind
+	// Func is the name of the test function containing the edit.
+	Func string
+	// Subtest is the name argument of the t.Run call the edit belongs to in Go syntax.
+	// It is empty for edits of the test function itself.
+	Subtest string
+	// SubtestPos is the position of the t.Run call the edit belongs to.
+	// It is the zero Position for edits of the test function itself.
+	SubtestPos token.Position
+	// Pos is the position of the opening brace of the block the statement is inserted into,
+	// or of the statement it replaces.
+	Pos token.Position
+	// Stmt is the inserted statement in Go syntax.
+	Stmt string
+}
+
+// Decision is the answer to a proposed Edit.
+type Decision int
+
+const (
+	// Accept inserts the statement.
+	Accept Decision = iota
+	// Skip does not insert the statement.
+	Skip
+	// SkipFile does not insert the statement nor any later statement of the file.
+	SkipFile
+	// OptOut does not insert the statement nor any other statement of the test function,
+	// dropping those accepted earlier, and adds the opt-out directive to the test function.
+	OptOut
+)
+
+// WithEditFilter makes GenerateTParallel ask f whether to insert each statement,
+// in the order they appear in the test functions.
+func WithEditFilter(f func(Edit) Decision) GenerateOption {
+	return func(o *generateOptions) {
+		o.editFilter = f
+	}
+}
+
+// reviewer applies the edit filter to the edits proposed while processing a file.
+type reviewer struct {
+	fs *token.FileSet
+	// src is the source of the file, before the edits.
+	src    []byte
+	filter func(Edit) Decision
+
+	skipFile bool
+	// optOut is the source before the edits of the functions opted out,
+	// by their index among the functions of the file.
+	optOut map[int][]byte
+}
+
+func newReviewer(fs *token.FileSet, src []byte, filter func(Edit) Decision) *reviewer {
+	return &reviewer{fs: fs, src: src, filter: filter, optOut: map[int][]byte{}}
+}
+
+// accept reports whether stmt is to be inserted at pos in funcDecl.
+// run is the call registering the subtest the statement belongs to, if any.
+func (r *reviewer) accept(f *ast.File, funcDecl *ast.FuncDecl, kind EditKind, run *ast.CallExpr, pos token.Pos, stmt ast.Stmt) bool {
+	if r.filter == nil {
+		return true
+	}
+
+	idx := funcIndex(f, funcDecl)
+	if _, ok := r.optOut[idx]; r.skipFile || ok {
+		return false
+	}
+
+	e := Edit{
+		Kind: kind,
+		Func: funcDecl.Name.Name,
+		Pos:  r.fs.Position(pos),
+		Stmt: nodeString(stmt),
+	}
+	if run != nil {
+		e.Subtest = nodeString(run.Args[0])
+		e.SubtestPos = r.fs.Position(run.Pos())
+	}
+
+	switch r.filter(e) {
+	case Accept:
+		return true
+	case SkipFile:
+		r.skipFile = true
+	case OptOut:
+		// The edits accepted earlier are dropped with the rest of the function. Its positions,
+		// unlike its statements, are those of the source before the edits.
+		r.optOut[idx] = r.src[r.fs.Position(funcDecl.Pos()).Offset:r.fs.Position(funcDecl.End()).Offset]
+	}
+
+	return false
+}
+
+// addOptOutDirectives restores the functions opted out in src, the formatted output of
+// GenerateTParallel, as they were before the edits, and adds the opt-out directive to them.
+// The imports added only for their edits are removed.
+func (r *reviewer) addOptOutDirectives(filename string, src []byte) ([]byte, error) {
+	if len(r.optOut) == 0 {
+		return src, nil
+	}
+
+	fs := token.NewFileSet()
+
+	f, err := parser.ParseFile(fs, filename, src, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		out  bytes.Buffer
+		last int
+	)
+
+	for _, decl := range f.Decls {
+		funcDecl, ok := decl.(*ast.FuncDecl)
+		if !ok {
+			continue
+		}
+
+		orig, ok := r.optOut[funcIndex(f, funcDecl)]
+		if !ok {
+			continue
+		}
+
+		pos := fs.Position(funcDecl.Pos())
+		lineStart := pos.Offset - (pos.Column - 1)
+
+		out.Write(src[last:lineStart])
+		out.WriteString(optOutDirective + "\n")
+		out.Write(src[lineStart:pos.Offset])
+		out.Write(orig)
+		last = fs.Position(funcDecl.End()).Offset
+	}
+
+	out.Write(src[last:])
+
+	return r.removeUnusedImports(filename, out.Bytes())
+}
+
+// removeUnusedImports removes from src the imports that are not in the source before
+// the edits and are not used, and formats it.
+func (r *reviewer) removeUnusedImports(filename string, src []byte) ([]byte, error) {
+	fs := token.NewFileSet()
+
+	f, err := parser.ParseFile(fs, filename, src, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+
+	orig, err := parser.ParseFile(token.NewFileSet(), filename, r.src, parser.ImportsOnly)
+	if err != nil {
+		return nil, err
+	}
+
+	imported := map[string]bool{}
+	for _, spec := range orig.Imports {
+		imported[spec.Path.Value] = true
+	}
+
+	specs := map[*ast.GenDecl]int{}
+
+	for _, decl := range f.Decls {
+		if gen, ok := decl.(*ast.GenDecl); ok && gen.Tok == token.IMPORT {
+			specs[gen] = len(gen.Specs)
+		}
+	}
+
+	// The deletions change f.Imports.
+	for _, spec := range slices.Clone(f.Imports) {
+		if imported[spec.Path.Value] {
+			continue
+		}
+
+		p, err := strconv.Unquote(spec.Path.Value)
+		if err != nil || astutil.UsesImport(f, p) {
+			continue
+		}
+
+		name := ""
+		if spec.Name != nil {
+			name = spec.Name.Name
+		}
+
+		astutil.DeleteNamedImport(fs, f, name, p)
+	}
+
+	// The parentheses the added import needed, such as import ("testing") after the deletion.
+	for gen, n := range specs {
+		if len(gen.Specs) == 1 && n > 1 {
+			gen.Lparen, gen.Rparen = token.NoPos, token.NoPos
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := format.Node(&buf, fs, f); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// funcIndex returns the index of funcDecl among the functions of f,
+// which the imports added by GenerateTParallel do not change.
+func funcIndex(f *ast.File, funcDecl *ast.FuncDecl) int {
+	i := 0
+
+	for _, decl := range f.Decls {
+		if decl == funcDecl {
+			return i
+		}
+
+		if _, ok := decl.(*ast.FuncDecl); ok {
+			i++
+		}
+	}
+
+	return -1
+}
+
+// nodeString returns n in Go syntax.
+func nodeString(n ast.Node) string {
+	var buf bytes.Buffer
+	if err := format.Node(&buf, token.NewFileSet(), n); err != nil {
+		return ""
+	}
+
+	return buf.String()
+}
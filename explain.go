@@ -0,0 +1,216 @@
+package tparagen
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Explanation is a decision GenerateTParallel made about a test or subtest, besides the
+// statements it inserts, which are explained with their Edit.
+type Explanation struct {
+	Pos token.Position
+	// Func is the name of the function concerned. It is empty for the file itself.
+	Func string
+	// Subtest is the name argument of the t.Run call concerned in Go syntax.
+	// It is empty for the function itself.
+	Subtest string
+	Message string
+}
+
+func (e Explanation) String() string {
+	target := e.Func
+	if e.Subtest != "" {
+		target = fmt.Sprintf("subtest %s of %s", e.Subtest, e.Func)
+	}
+
+	if target == "" {
+		return fmt.Sprintf("%s: %s", e.Pos, e.Message)
+	}
+
+	return fmt.Sprintf("%s: %s %s", e.Pos, target, e.Message)
+}
+
+// WithExplanations makes GenerateTParallel report its decisions about the tests and subtests to f.
+func WithExplanations(f func(Explanation)) GenerateOption {
+	return func(o *generateOptions) {
+		o.explanations = f
+	}
+}
+
+func (o *generateOptions) explain(fs *token.FileSet, pos token.Pos, funcName string, subtest ast.Expr, message string) {
+	if o.explanations == nil {
+		return
+	}
+
+	e := Explanation{Pos: fs.Position(pos), Func: funcName, Message: message}
+	if subtest != nil {
+		e.Subtest = nodeString(subtest)
+	}
+
+	o.explanations(e)
+}
+
+// explainSerialSubtest explains why fun, the callback of the subtest registered by run with
+// the *testing.T parameter testVar, is left as is: it calls Parallel() or Setenv() already.
+func (o *generateOptions) explainSerialSubtest(scope *pkgScope, decl *ast.FuncDecl, run *ast.CallExpr, fun *ast.FuncLit, testVar string) {
+	if o.explanations == nil {
+		return
+	}
+
+	ast.Inspect(fun.Body, func(n ast.Node) bool {
+		switch {
+		case scope.hasParallelCall(n, testVar):
+			o.explain(scope.fs, n.Pos(), decl.Name.Name, run.Args[0], "already calls Parallel")
+		case scope.hasSetenvCall(n, testVar):
+			o.explain(scope.fs, n.Pos(), decl.Name.Name, run.Args[0], fmt.Sprintf("calls %s, not parallelised", nodeString(n.(*ast.CallExpr).Fun)))
+		default:
+			return true
+		}
+
+		return false
+	})
+}
+
+// explainCallback explains why the subtest registered by run is left as is: its callback is not
+// a function literal with a named *testing.T parameter.
+func (o *generateOptions) explainCallback(fs *token.FileSet, decl *ast.FuncDecl, run *ast.CallExpr) {
+	if len(run.Args) != 2 {
+		return
+	}
+
+	if _, ok := run.Args[1].(*ast.FuncLit); ok {
+		o.explain(fs, run.Args[1].Pos(), decl.Name.Name, run.Args[0], "has a callback without a named *testing.T parameter, not parallelised")
+
+		return
+	}
+
+	o.explain(fs, run.Args[1].Pos(), decl.Name.Name, run.Args[0], "has a callback that is not a function literal, not parallelised")
+}
+
+// explainNested explains that the subtests registered in fun, the callback of the subtest registered
+// by run with the *testing.T parameter testVar, are not processed.
+func (o *generateOptions) explainNested(scope *pkgScope, decl *ast.FuncDecl, run *ast.CallExpr, fun *ast.FuncLit, testVar string) {
+	if o.explanations == nil {
+		return
+	}
+
+	ast.Inspect(fun.Body, func(n ast.Node) bool {
+		if call, ok := n.(*ast.CallExpr); ok && hasRunMethod(call, testVar) && len(call.Args) == 2 {
+			o.explain(scope.fs, call.Pos(), decl.Name.Name, call.Args[0], fmt.Sprintf("is nested in subtest %s, not parallelised", nodeString(run.Args[0])))
+
+			return false
+		}
+
+		return true
+	})
+}
+
+// explainEdit returns the explanation of e, a statement GenerateTParallel inserts.
+func explainEdit(e Edit) Explanation {
+	var message string
+
+	switch e.Kind {
+	case EditParallel:
+		message = "gets " + e.Stmt
+	case EditLoopVarCopy:
+		message = "copies the loop variable captured by its subtests, " + e.Stmt
+	case EditDeferToCleanup:
+		message = "replaces the defer statement with " + e.Stmt
+	case EditGroup:
+		message = "wraps the loop in a group subtest"
+	}
+
+	return Explanation{Pos: e.Pos, Func: e.Func, Subtest: e.Subtest, Message: message}
+}
+
+// Explain writes the decisions of Run about the test file at path: the statements it would
+// insert, why the tests and subtests are left as is, and the findings. If line is positive,
+// only the function containing the line is explained. The file is not changed.
+func Explain(w io.Writer, path string, line int, minGoVersion float64, opts ...Option) error {
+	t := newTparagen(io.Discard, io.Discard, minGoVersion, opts...)
+
+	if !isTestFile(path) {
+		return fmt.Errorf("%s is not a test file", path)
+	}
+
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("cannot read %s. %w", path, err)
+	}
+
+	p, err := findSerialPackage(filepath.Dir(path), nil, t.processTestMain)
+	if err != nil {
+		return fmt.Errorf("cannot analyse the package of %s. %w", path, err)
+	}
+
+	if p != nil {
+		fmt.Fprintln(w, p.diagnostic().String())
+
+		return nil
+	}
+
+	genOpts, err := t.generateOptions(target{path: path})
+	if err != nil {
+		return err
+	}
+
+	if line > 0 {
+		genOpts = append(genOpts, WithLineRanges(LineRange{Start: line, End: line}))
+	}
+
+	type entry struct {
+		pos  token.Position
+		text string
+	}
+
+	var entries []entry
+
+	genOpts = append(genOpts,
+		WithEditFilter(func(e Edit) Decision {
+			entries = append(entries, entry{e.Pos, explainEdit(e).String()})
+
+			return Accept
+		}),
+		WithExplanations(func(e Explanation) {
+			entries = append(entries, entry{e.Pos, e.String()})
+		}),
+		WithDiagnostics(func(d Diagnostic) {
+			entries = append(entries, entry{d.Pos, d.String()})
+		}),
+	)
+
+	if _, err := GenerateTParallel(path, src, t.needFixLoopVar, genOpts...); err != nil {
+		return fmt.Errorf("error occurred in Process(). %w", err)
+	}
+
+	// The entries of the other files of the package, such as the helpers causing a finding, come last.
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i].pos, entries[j].pos
+		if a.Filename != b.Filename {
+			if a.Filename == path || b.Filename == path {
+				return a.Filename == path
+			}
+
+			return a.Filename < b.Filename
+		}
+
+		return a.Offset < b.Offset
+	})
+
+	if len(entries) == 0 {
+		fmt.Fprintf(w, "%s: nothing to explain\n", path)
+
+		return nil
+	}
+
+	for _, e := range entries {
+		fmt.Fprintln(w, e.text)
+	}
+
+	return nil
+}
@@ -0,0 +1,97 @@
+package tparagen
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const explainTestSrc = `package t
+
+import "testing"
+
+func TestMain2(t *testing.T) {
+	for _, tc := range []struct{ name string }{{"a"}} {
+		t.Run(tc.name, func(t *testing.T) {
+			_ = tc
+			t.Run("nested", func(t *testing.T) {})
+		})
+	}
+
+	t.Run("run", run)
+	t.Run("serial", func(t *testing.T) {
+		t.Parallel()
+	})
+}
+
+func TestAlreadyParallel(t *testing.T) {
+	t.Parallel()
+}
+
+func TestSetenv(t *testing.T) {
+	t.Setenv("A", "b")
+}
+
+//nolint:paralleltest
+func TestOptOut(t *testing.T) {}
+
+func run(t *testing.T) {}
+`
+
+func TestExplain(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "t_test.go")
+	if err := os.WriteFile(path, []byte(explainTestSrc), 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	tests := []struct {
+		testCase string
+		line     int
+		want     []string
+	}{
+		{
+			testCase: "whole file",
+			want: []string{
+				":5:30: TestMain2 gets t.Parallel()",
+				":6:52: TestMain2 copies the loop variable captured by its subtests, tc := tc",
+				":7:37: subtest tc.name of TestMain2 gets t.Parallel()",
+				`:9:4: subtest "nested" of TestMain2 is nested in subtest tc.name, not parallelised`,
+				`:13:15: subtest "run" of TestMain2 has a callback that is not a function literal, not parallelised`,
+				`:15:3: subtest "serial" of TestMain2 already calls Parallel`,
+				":20:2: TestAlreadyParallel already calls Parallel",
+				":24:2: TestSetenv calls t.Setenv, not parallelised",
+				":27:1: TestOptOut has a nolint directive, not parallelised",
+			},
+		},
+		{
+			testCase: "line",
+			line:     24,
+			want: []string{
+				":24:2: TestSetenv calls t.Setenv, not parallelised",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testCase, func(t *testing.T) {
+			t.Parallel()
+
+			var out strings.Builder
+			if err := Explain(&out, path, tt.line, 1.21); err != nil {
+				t.Fatalf("Explain() returned error: %v", err)
+			}
+
+			var want strings.Builder
+			for _, w := range tt.want {
+				want.WriteString(path + w + "\n")
+			}
+
+			if out.String() != want.String() {
+				t.Errorf("Explain() wrote:\n%s, want:\n%s", out.String(), want.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package tparagen
+
+import (
+	"io/fs"
+	"os"
+)
+
+// chown is a no-op on platforms without POSIX file ownership.
+func chown(_ *os.File, _ fs.FileInfo) error {
+	return nil
+}
@@ -0,0 +1,32 @@
+//go:build unix
+
+package tparagen
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// chown gives f the owner and group of the file described by info, where permitted.
+// An unprivileged user may rewrite a file owned by someone else, such as a group-writable
+// one, but not give the rewritten file its owner; it is then left owned by the user.
+func chown(f *os.File, info fs.FileInfo) error {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+
+	// Nothing to do if the owner already matches, which also avoids
+	// permission errors for unprivileged users.
+	if int(st.Uid) == os.Getuid() && int(st.Gid) == os.Getgid() {
+		return nil
+	}
+
+	if err := f.Chown(int(st.Uid), int(st.Gid)); err != nil && !errors.Is(err, fs.ErrPermission) {
+		return err
+	}
+
+	return nil
+}
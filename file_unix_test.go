@@ -0,0 +1,59 @@
+//go:build unix
+
+package tparagen
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// otherOwnerInfo is the FileInfo of a file owned by another user.
+type otherOwnerInfo struct {
+	fs.FileInfo
+	st *syscall.Stat_t
+}
+
+func (i otherOwnerInfo) Sys() any { return i.st }
+
+func TestWriteTempFileWithOtherOwner(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "a_test.go")
+	if err := os.WriteFile(path, []byte(rewritableTestSrc), 0o664); err != nil {
+		t.Fatalf("failed to write test file: %v", err)
+	}
+
+	if err := os.Chmod(path, 0o664); err != nil {
+		t.Fatalf("failed to chmod test file: %v", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("failed to stat file: %v", err)
+	}
+
+	// Only root can give a file to another user; the others keep writing the file as themselves.
+	owner := &syscall.Stat_t{Uid: uint32(os.Getuid() + 1), Gid: uint32(os.Getgid() + 1)}
+
+	tmpPath, err := writeTempFile(path, otherOwnerInfo{info, owner}, []byte(rewritableTestSrc))
+	if err != nil {
+		t.Fatalf("writeTempFile() returned error: %v", err)
+	}
+
+	got, err := os.Stat(tmpPath)
+	if err != nil {
+		t.Fatalf("failed to stat temp file: %v", err)
+	}
+
+	if got.Mode().Perm() != 0o664 {
+		t.Errorf("expected mode 0664, got %o", got.Mode().Perm())
+	}
+
+	st := got.Sys().(*syscall.Stat_t)
+	if os.Getuid() == 0 && (st.Uid != owner.Uid || st.Gid != owner.Gid) {
+		t.Errorf("expected owner %d:%d, got %d:%d", owner.Uid, owner.Gid, st.Uid, st.Gid)
+	}
+}
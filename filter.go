@@ -0,0 +1,57 @@
+package tparagen
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+)
+
+// Filter reads a single Go source file from in, inserts t.Parallel() in the same way
+// as Run, and writes the result to out. It is meant for editor integrations that pipe
+// a buffer through a formatter.
+// filename is the path of the source, used in messages. Sources that are not test files
+// are written out unchanged; an empty filename is taken as a test file. Options that
+// select files, such as WithSince, are ignored.
+func Filter(in io.Reader, out io.Writer, filename string, minGoVersion float64, opts ...Option) error {
+	t := newTparagen(io.Discard, io.Discard, minGoVersion, opts...)
+
+	isTest := filename == "" || isTestFile(filename)
+	if filename == "" {
+		filename = "<standard input>"
+	}
+
+	src, err := io.ReadAll(in)
+	if err != nil {
+		return fmt.Errorf("cannot read %s. %w", filename, err)
+	}
+
+	if isTest && filename != "<standard input>" {
+		// The source replaces the file on disk in the package-level analysis.
+		p, err := findSerialPackage(filepath.Dir(filename), map[string][]byte{filepath.Clean(filename): src}, t.processTestMain)
+		if err != nil {
+			return fmt.Errorf("cannot analyse the package of %s. %w", filename, err)
+		}
+
+		isTest = p == nil
+	}
+
+	got := src
+	if isTest {
+		var opts []GenerateOption
+		if filename == "<standard input>" {
+			opts = t.genOpts
+		} else if opts, err = t.generateOptions(target{path: filename}); err != nil {
+			return err
+		}
+
+		if got, err = GenerateTParallel(filename, src, t.needFixLoopVar, opts...); err != nil {
+			return fmt.Errorf("error occurred in Process(). %w", err)
+		}
+	}
+
+	if _, err := out.Write(got); err != nil {
+		return fmt.Errorf("cannot write %s. %w", filename, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,58 @@
+package tparagen
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		testCase  string
+		filename  string
+		rewritten bool
+	}{
+		{testCase: "test file", filename: "foo/foo_test.go", rewritten: true},
+		{testCase: "no file name", filename: "", rewritten: true},
+		{testCase: "not a test file", filename: "foo/foo.go", rewritten: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testCase, func(t *testing.T) {
+			t.Parallel()
+
+			var out bytes.Buffer
+			if err := Filter(strings.NewReader(rewritableTestSrc), &out, tt.filename, 1.22, WithCacheDir("")); err != nil {
+				t.Fatalf("Filter() returned error: %v", err)
+			}
+
+			if got := out.String() != rewritableTestSrc; got != tt.rewritten {
+				t.Errorf("rewritten: %v, want: %v\n%s", got, tt.rewritten, out.String())
+			}
+		})
+	}
+}
+
+func TestParseGoDirective(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		gomod string
+		want  float64
+		ok    bool
+	}{
+		{gomod: "module example.com/m\n\ngo 1.21\n", want: 1.21, ok: true},
+		{gomod: "module example.com/m\n\ngo 1.23.0\n", want: 1.23, ok: true},
+		{gomod: "module example.com/m\n\ngo 1.9\n", want: 1.09, ok: true},
+		{gomod: "module example.com/m\n", ok: false},
+	}
+
+	for _, tt := range tests {
+		got, ok := parseGoDirective([]byte(tt.gomod))
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseGoDirective(%q) = %v, %v, want: %v, %v", tt.gomod, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package tparagen
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strconv"
+	"strings"
+)
+
+// TestFramework detects the test entry points of a test framework.
+type TestFramework interface {
+	// Name identifies the framework.
+	Name() string
+	// TestExpr returns the expression yielding the *testing.T of funcDecl, a function of f,
+	// in Go syntax, if funcDecl is a test entry point of the framework.
+	TestExpr(f *ast.File, funcDecl *ast.FuncDecl) (string, bool)
+}
+
+// WithTestFrameworks makes GenerateTParallel also parallelise the test entry points
+// of the given frameworks, in addition to the Test functions run by go test.
+func WithTestFrameworks(frameworks ...TestFramework) GenerateOption {
+	return func(o *generateOptions) {
+		o.frameworks = append(o.frameworks, frameworks...)
+	}
+}
+
+// GoTest returns the framework of the functions run by go test, func TestXxx(t *testing.T).
+// It is always enabled.
+func GoTest() TestFramework {
+	return goTest{}
+}
+
+type goTest struct{}
+
+func (goTest) Name() string {
+	return "go test"
+}
+
+func (goTest) TestExpr(_ *ast.File, funcDecl *ast.FuncDecl) (string, bool) {
+	isTest, testVar := isTestFunction(funcDecl)
+
+	return testVar, isTest
+}
+
+// testifySuitePackage is the import path of the test suites of testify.
+const testifySuitePackage = "github.com/stretchr/testify/suite"
+
+// TestifySuite returns the framework of the test suites of github.com/stretchr/testify/suite,
+// whose entry points are the methods func (s *MySuite) TestXxx(), with s.T() yielding the *testing.T,
+// of the types embedding suite.Suite declared in the same file.
+//
+// testify runs all the methods of a suite on one value and replaces the *testing.T of the
+// suite with that of each method, so parallel methods share the fields of the suite and
+// s.T() may return the *testing.T of another method. It is only safe for the suites whose
+// methods use neither the fields nor s.T() once they are parallel, and is not enabled by default.
+func TestifySuite() TestFramework {
+	return testifySuite{}
+}
+
+type testifySuite struct{}
+
+func (testifySuite) Name() string {
+	return "testify"
+}
+
+func (testifySuite) TestExpr(f *ast.File, funcDecl *ast.FuncDecl) (string, bool) {
+	recv, ok := suiteMethodRecv(funcDecl)
+	if !ok || funcDecl.Type.Params.NumFields() != 0 || !embedsTestifySuite(f, recvTypeName(funcDecl)) {
+		return "", false
+	}
+
+	return recv + ".T()", true
+}
+
+// embedsTestifySuite reports whether typeName is a struct type declared in f embedding suite.Suite
+// of testify.
+func embedsTestifySuite(f *ast.File, typeName string) bool {
+	suiteName, ok := importedAs(f, testifySuitePackage)
+	if !ok {
+		return false
+	}
+
+	for _, decl := range f.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.TYPE {
+			continue
+		}
+
+		for _, spec := range gen.Specs {
+			ts, ok := spec.(*ast.TypeSpec)
+			if !ok || ts.Name.Name != typeName {
+				continue
+			}
+
+			st, ok := ts.Type.(*ast.StructType)
+			if !ok {
+				return false
+			}
+
+			for _, field := range st.Fields.List {
+				typ := field.Type
+				if star, ok := typ.(*ast.StarExpr); ok {
+					typ = star.X
+				}
+
+				if len(field.Names) == 0 && isSelector(typ, suiteName, "Suite") {
+					return true
+				}
+			}
+
+			return false
+		}
+	}
+
+	return false
+}
+
+// importedAs returns the name the package of importPath is imported as in f.
+func importedAs(f *ast.File, importPath string) (string, bool) {
+	for _, spec := range f.Imports {
+		if p, err := strconv.Unquote(spec.Path.Value); err != nil || p != importPath {
+			continue
+		}
+
+		if spec.Name != nil {
+			return spec.Name.Name, spec.Name.Name != "_" && spec.Name.Name != "."
+		}
+
+		return importName(importPath), true
+	}
+
+	return "", false
+}
+
+// SuiteType returns the framework of a test-suite type run by a custom runner, whose
+// entry points are the methods of the type named TestXxx. The *testing.T is either the only
+// parameter of the methods, as in func (s *MySuite) TestXxx(t *testing.T), or, if they take
+// no parameter, the receiver itself, whose type embeds *testing.T.
+func SuiteType(typeName string) TestFramework {
+	return suiteType{typeName: typeName}
+}
+
+type suiteType struct {
+	typeName string
+}
+
+func (s suiteType) Name() string {
+	return "suite " + s.typeName
+}
+
+func (s suiteType) TestExpr(_ *ast.File, funcDecl *ast.FuncDecl) (string, bool) {
+	recv, ok := suiteMethodRecv(funcDecl)
+	if !ok || recvTypeName(funcDecl) != s.typeName {
+		return "", false
+	}
+
+	if funcDecl.Type.Params.NumFields() == 0 {
+		return recv, true
+	}
+
+	isTest, testVar := isTestFunction(funcDecl)
+
+	return testVar, isTest
+}
+
+// suiteMethodRecv returns the name of the receiver of funcDecl if it is a method named TestXxx
+// with a named receiver and no result.
+func suiteMethodRecv(funcDecl *ast.FuncDecl) (string, bool) {
+	if funcDecl.Recv == nil || len(funcDecl.Recv.List) != 1 || len(funcDecl.Recv.List[0].Names) != 1 {
+		return "", false
+	}
+
+	if !strings.HasPrefix(funcDecl.Name.Name, testPrefix) || funcDecl.Type.Results.NumFields() != 0 {
+		return "", false
+	}
+
+	name := funcDecl.Recv.List[0].Names[0].Name
+	if name == "_" {
+		return "", false
+	}
+
+	return name, true
+}
+
+// recvTypeName returns the name of the receiver type of funcDecl, a method.
+func recvTypeName(funcDecl *ast.FuncDecl) string {
+	typ := funcDecl.Recv.List[0].Type
+	if star, ok := typ.(*ast.StarExpr); ok {
+		typ = star.X
+	}
+
+	// Drop the type parameters of a generic type.
+	switch t := typ.(type) {
+	case *ast.IndexExpr:
+		typ = t.X
+	case *ast.IndexListExpr:
+		typ = t.X
+	}
+
+	if id, ok := typ.(*ast.Ident); ok {
+		return id.Name
+	}
+
+	return ""
+}
+
+// testEntryPoint returns the expression yielding the *testing.T of funcDecl
+// if it is a test entry point of one of the frameworks.
+func (o *generateOptions) testEntryPoint(f *ast.File, funcDecl *ast.FuncDecl) (string, bool) {
+	for _, fw := range append([]TestFramework{GoTest()}, o.frameworks...) {
+		if testExpr, ok := fw.TestExpr(f, funcDecl); ok && testExpr != "" {
+			return testExpr, true
+		}
+	}
+
+	return "", false
+}
+
+// buildTestExpr returns testExpr, an expression in Go syntax such as t or s.T(), at pos.
+func buildTestExpr(pos token.Pos, testExpr string) ast.Expr {
+	e, err := parser.ParseExpr(testExpr)
+	if err != nil {
+		return &ast.Ident{NamePos: pos, Name: testExpr}
+	}
+
+	ast.Inspect(e, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.Ident:
+			n.NamePos = pos
+		case *ast.CallExpr:
+			n.Lparen, n.Rparen = pos, pos
+		case *ast.ParenExpr:
+			n.Lparen, n.Rparen = pos, pos
+		case *ast.StarExpr:
+			n.Star = pos
+		case *ast.TypeAssertExpr:
+			n.Lparen, n.Rparen = pos, pos
+		case *ast.BasicLit:
+			n.ValuePos = pos
+		}
+
+		return true
+	})
+
+	return e
+}
@@ -0,0 +1,101 @@
+package tparagen
+
+import (
+	"fmt"
+	"go/ast"
+	"go/types"
+	"strings"
+)
+
+// funcSet is a set of functions and methods given by their fully-qualified names,
+// such as "github.com/acme/testutil.SetGlobalClock" or "github.com/acme/dbtest.DB.Reset".
+type funcSet struct {
+	// funcs are the functions keyed by import path.
+	funcs map[string][]string
+	// methods are the methods as "import/path.Type.Method".
+	methods map[string]bool
+}
+
+// parseFuncSet parses fully-qualified function and method names. Methods may also
+// be written as "(*import/path.Type).Method".
+func parseFuncSet(names []string) (*funcSet, error) {
+	s := &funcSet{funcs: map[string][]string{}, methods: map[string]bool{}}
+
+	for _, name := range names {
+		n := strings.TrimSpace(name)
+
+		// (*import/path.Type).Method
+		if strings.HasPrefix(n, "(") {
+			recv, method, ok := strings.Cut(n[1:], ").")
+			if !ok {
+				return nil, fmt.Errorf("invalid function name %q", name)
+			}
+
+			n = strings.TrimPrefix(recv, "*") + "." + method
+		}
+
+		slash := strings.LastIndex(n, "/")
+		parts := strings.Split(n[slash+1:], ".")
+		dir := n[:slash+1]
+
+		for _, p := range parts {
+			if p == "" {
+				return nil, fmt.Errorf("invalid function name %q", name)
+			}
+		}
+
+		switch len(parts) {
+		case 2:
+			s.funcs[dir+parts[0]] = append(s.funcs[dir+parts[0]], parts[1])
+		case 3:
+			s.methods[n] = true
+		default:
+			return nil, fmt.Errorf("invalid function name %q", name)
+		}
+	}
+
+	return s, nil
+}
+
+func (s *funcSet) hasMethods() bool {
+	return s != nil && len(s.methods) != 0
+}
+
+// containsCall reports whether call calls a function or method of the set.
+// Functions are resolved through the imports of the file, or the type information if any;
+// methods need the type information.
+func (s *funcSet) containsCall(scope *pkgScope, call *ast.CallExpr) bool {
+	if s == nil {
+		return false
+	}
+
+	if p, name, ok := scope.calledFunc(call); ok && containsFunc(s.funcs, p, name) {
+		return true
+	}
+
+	if scope.info == nil {
+		return false
+	}
+
+	f, ok := calledFuncObj(scope.info, call)
+	if !ok || f.Pkg() == nil {
+		return false
+	}
+
+	recv := f.Signature().Recv()
+	if recv == nil {
+		return containsFunc(s.funcs, f.Pkg().Path(), f.Name())
+	}
+
+	t := recv.Type()
+	if ptr, ok := t.(*types.Pointer); ok {
+		t = ptr.Elem()
+	}
+
+	named, ok := t.(*types.Named)
+	if !ok || named.Obj().Pkg() == nil {
+		return false
+	}
+
+	return s.methods[named.Obj().Pkg().Path()+"."+named.Obj().Name()+"."+f.Name()]
+}
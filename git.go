@@ -0,0 +1,159 @@
+package tparagen
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// LineRange is an inclusive range of 1-based line numbers.
+type LineRange struct {
+	Start, End int
+}
+
+func (r LineRange) overlaps(start, end int) bool {
+	return r.Start <= end && start <= r.End
+}
+
+// gitChanges returns the test files changed according to git in the repository
+// containing dir, together with the changed line ranges of each file.
+// If staged is true, the changes staged in the index are returned; otherwise,
+// the changes in the working tree since the since revision, including untracked files.
+// The keys of the returned map are absolute paths. A nil slice of ranges means the whole file.
+func gitChanges(ctx context.Context, dir, since string, staged bool) (map[string][]LineRange, error) {
+	out, err := git(ctx, dir, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, err
+	}
+
+	root := strings.TrimSpace(string(out))
+
+	// The prefixes are set explicitly, as diff.noprefix and diff.mnemonicPrefix change them.
+	args := []string{"diff", "--no-color", "--no-ext-diff", "--no-renames", "--src-prefix=a/", "--dst-prefix=b/", "-U0", "--diff-filter=AM"}
+	if staged {
+		args = append(args, "--cached")
+	} else {
+		args = append(args, since)
+	}
+
+	out, err = git(ctx, root, append(args, "--", "*_test.go")...)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := map[string][]LineRange{}
+	for rel, ranges := range parseUnifiedDiff(out) {
+		changes[filepath.Join(root, filepath.FromSlash(rel))] = ranges
+	}
+
+	if staged {
+		return changes, nil
+	}
+
+	// Files not yet tracked by git are not included in the diff; they are changed as a whole.
+	out, err = git(ctx, root, "ls-files", "-z", "--others", "--exclude-standard", "--", "*_test.go")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rel := range strings.Split(string(out), "\x00") {
+		if rel != "" {
+			changes[filepath.Join(root, filepath.FromSlash(rel))] = nil
+		}
+	}
+
+	return changes, nil
+}
+
+func git(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-C", dir}, args...)...)
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s failed. %w: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+
+	return out, nil
+}
+
+// parseUnifiedDiff returns the line ranges added or modified in each file of a
+// unified diff generated with zero context lines.
+// The keys of the returned map are the slash-separated paths relative to the repository root.
+func parseUnifiedDiff(diff []byte) map[string][]LineRange {
+	changes := map[string][]LineRange{}
+
+	var file string
+
+	sc := bufio.NewScanner(bytes.NewReader(diff))
+	sc.Buffer(nil, 1024*1024)
+
+	for sc.Scan() {
+		line := sc.Text()
+
+		switch {
+		case strings.HasPrefix(line, "+++ "):
+			file = ""
+			if name, ok := strings.CutPrefix(diffPath(line[len("+++ "):]), "b/"); ok {
+				file = name
+				changes[file] = []LineRange{}
+			}
+		case strings.HasPrefix(line, "@@ ") && file != "":
+			if r, ok := parseHunkHeader(line); ok {
+				changes[file] = append(changes[file], r)
+			}
+		}
+	}
+
+	return changes
+}
+
+// diffPath returns the path of a file header of a diff, such as b/foo_test.go. git quotes the paths
+// with special characters like a Go string, such as "b/\303\251_test.go", and ends the ones
+// containing spaces with a tab.
+func diffPath(s string) string {
+	s = strings.TrimSuffix(s, "\t")
+	if strings.HasPrefix(s, `"`) {
+		if p, err := strconv.Unquote(s); err == nil {
+			return p
+		}
+	}
+
+	return s
+}
+
+// parseHunkHeader parses the new file range of a hunk header such as "@@ -1,2 +3,4 @@".
+func parseHunkHeader(line string) (LineRange, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 || !strings.HasPrefix(fields[2], "+") {
+		return LineRange{}, false
+	}
+
+	startStr, countStr, hasCount := strings.Cut(strings.TrimPrefix(fields[2], "+"), ",")
+
+	start, err := strconv.Atoi(startStr)
+	if err != nil {
+		return LineRange{}, false
+	}
+
+	count := 1
+	if hasCount {
+		if count, err = strconv.Atoi(countStr); err != nil {
+			return LineRange{}, false
+		}
+	}
+
+	// Lines were only removed; the change is right after the start line.
+	if count == 0 {
+		return LineRange{Start: start, End: start + 1}, true
+	}
+
+	return LineRange{Start: start, End: start + count - 1}, true
+}
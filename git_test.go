@@ -0,0 +1,138 @@
+package tparagen
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseUnifiedDiff(t *testing.T) {
+	t.Parallel()
+
+	diff := `diff --git a/foo_test.go b/foo_test.go
+index 1111111..2222222 100644
+--- a/foo_test.go
++++ b/foo_test.go
+@@ -3 +3 @@ import "testing"
+-func TestA(t *testing.T) {}
++func TestA(t *testing.T) { t.Log("a") }
+@@ -10,2 +10,3 @@ func TestB(t *testing.T) {
++	t.Log("b")
+@@ -20,2 +21,0 @@ func TestC(t *testing.T) {
+diff --git a/bar/new_test.go b/bar/new_test.go
+new file mode 100644
+--- /dev/null
++++ b/bar/new_test.go
+@@ -0,0 +1,5 @@
++package bar
+diff --git "a/\303\251_test.go" "b/\303\251_test.go"
+--- "a/\303\251_test.go"
++++ "b/\303\251_test.go"
+@@ -2 +2 @@
++import "testing"
+diff --git a/foo bar_test.go b/foo bar_test.go
+--- a/foo bar_test.go	
++++ b/foo bar_test.go	
+@@ -4 +4 @@
++func TestD(t *testing.T) {}
+`
+
+	want := map[string][]LineRange{
+		"foo_test.go":     {{Start: 3, End: 3}, {Start: 10, End: 12}, {Start: 21, End: 22}},
+		"bar/new_test.go": {{Start: 1, End: 5}},
+		"é_test.go":       {{Start: 2, End: 2}},
+		"foo bar_test.go": {{Start: 4, End: 4}},
+	}
+
+	if got := parseUnifiedDiff([]byte(diff)); !reflect.DeepEqual(got, want) {
+		t.Errorf("result:\n%v, want:\n%v", got, want)
+	}
+}
+
+func TestGitChanges(t *testing.T) {
+	t.Parallel()
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git command is not available")
+	}
+
+	repo := t.TempDir()
+	runGit := func(args ...string) {
+		t.Helper()
+
+		if out, err := exec.Command("git", append([]string{"-C", repo}, args...)...).CombinedOutput(); err != nil {
+			t.Fatalf("git %s failed: %v: %s", strings.Join(args, " "), err, out)
+		}
+	}
+	writeFile := func(name, src string) {
+		t.Helper()
+
+		if err := os.WriteFile(filepath.Join(repo, name), []byte(src), 0o644); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+	}
+
+	runGit("init", "-q")
+	// The settings changing the paths in the diff output.
+	runGit("config", "diff.noprefix", "true")
+	runGit("config", "diff.mnemonicPrefix", "true")
+	runGit("config", "core.quotePath", "true")
+
+	writeFile("a_test.go", "package a\n\nimport \"testing\"\n")
+	writeFile("é b_test.go", "package a\n")
+	runGit("add", ".")
+	runGit("-c", "user.name=t", "-c", "user.email=t@example.com", "commit", "-q", "-m", "init")
+
+	writeFile("a_test.go", "package a\n\nimport \"testing\"\n\nfunc TestA(t *testing.T) {}\n")
+	writeFile("é b_test.go", "package a\n\nfunc helper() {}\n")
+	writeFile("new é_test.go", "package a\n")
+
+	// Run from a symbolic link to the repository, which git resolves.
+	link := filepath.Join(t.TempDir(), "link")
+	if err := os.Symlink(repo, link); err != nil {
+		t.Skipf("symbolic links are not supported: %v", err)
+	}
+
+	got, err := gitChanges(context.Background(), link, "HEAD", false)
+	if err != nil {
+		t.Fatalf("gitChanges() returned error: %v", err)
+	}
+
+	root, err := filepath.EvalSymlinks(repo)
+	if err != nil {
+		t.Fatalf("failed to resolve %s: %v", repo, err)
+	}
+
+	want := map[string][]LineRange{
+		filepath.Join(root, "a_test.go"):     {{Start: 4, End: 5}},
+		filepath.Join(root, "é b_test.go"):   {{Start: 2, End: 3}},
+		filepath.Join(root, "new é_test.go"): nil,
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("result:\n%v, want:\n%v", got, want)
+	}
+
+	var targets []target
+
+	r := newRunner(link)
+	r.since = "HEAD"
+
+	ch := make(chan target, len(want))
+	if err := r.discoverChanged(context.Background(), ch); err != nil {
+		t.Fatalf("discoverChanged() returned error: %v", err)
+	}
+	close(ch)
+
+	for tg := range ch {
+		targets = append(targets, tg)
+	}
+
+	if len(targets) != len(want) {
+		t.Errorf("expected %d targets under the symbolic link, got %v", len(want), targets)
+	}
+}
@@ -5,10 +5,11 @@ go 1.23.0
 require (
 	github.com/alecthomas/kingpin/v2 v2.3.2
 	github.com/saracen/walker v0.1.3
+	golang.org/x/sync v0.8.0
+	golang.org/x/tools v0.24.0
 )
 
 require (
 	github.com/alecthomas/units v0.0.0-20211218093645-b94a6e3cc137 // indirect
 	github.com/xhit/go-str2duration/v2 v2.1.0 // indirect
-	golang.org/x/sync v0.1.0 // indirect
 )
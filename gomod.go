@@ -0,0 +1,79 @@
+package tparagen
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ModuleGoVersion returns the Go version declared by the go directive of the go.mod
+// file of the module containing dir, in the same form as the minimum Go version given to Run.
+// It reports false if no go.mod file or go directive is found.
+func ModuleGoVersion(dir string) (float64, bool) {
+	root, ok := moduleRoot(dir)
+	if !ok {
+		return 0, false
+	}
+
+	b, err := os.ReadFile(filepath.Join(root, "go.mod"))
+	if err != nil {
+		return 0, false
+	}
+
+	return parseGoDirective(b)
+}
+
+// moduleRoot returns the absolute path of the directory of the go.mod file of the module containing dir.
+func moduleRoot(dir string) (string, bool) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", false
+	}
+
+	for {
+		if fi, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil && !fi.IsDir() {
+			return dir, true
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", false
+		}
+
+		dir = parent
+	}
+}
+
+// parseGoDirective parses the go directive of a go.mod file such as "go 1.22.1".
+func parseGoDirective(gomod []byte) (float64, bool) {
+	sc := bufio.NewScanner(bytes.NewReader(gomod))
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 2 || fields[0] != "go" {
+			continue
+		}
+
+		parts := strings.SplitN(fields[1], ".", 3)
+		if len(parts) < 2 {
+			return 0, false
+		}
+
+		major, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return 0, false
+		}
+
+		minor, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return 0, false
+		}
+
+		// The minor version is scaled so that e.g. 1.9 is lower than 1.22.
+		return float64(major) + float64(minor)/100, true
+	}
+
+	return 0, false
+}
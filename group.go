@@ -0,0 +1,198 @@
+package tparagen
+
+import (
+	"go/ast"
+	"go/token"
+	"strconv"
+)
+
+// groupSubtestName is the name of the subtest wrapping a loop registering parallel subtests.
+const groupSubtestName = "group"
+
+// WithSubtestGroups makes GenerateTParallel wrap each range loop of a test registering the subtests it
+// parallelises in t.Run("group", func(t *testing.T) {...}) when the test has defer statements or
+// statements after the loop, so that they still run after the subtests, which finish with the group.
+// The names of the subtests get the group prefix, such as TestFoo/group/case.
+func WithSubtestGroups() GenerateOption {
+	return func(o *generateOptions) {
+		o.groupSubtests = true
+	}
+}
+
+// needsGroup reports whether the statements of body, a test function registering parallel subtests
+// in the loop r, one of its statements, would run before the subtests: defer statements of the test,
+// or the statements after r.
+func needsGroup(body *ast.BlockStmt, r *ast.RangeStmt) bool {
+	for i, stmt := range body.List {
+		if stmt == r {
+			if i < len(body.List)-1 {
+				return true
+			}
+
+			break
+		}
+	}
+
+	var hasDefer bool
+
+	ast.Inspect(body, func(n ast.Node) bool {
+		switch n.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.DeferStmt:
+			hasDefer = true
+		}
+
+		return !hasDefer
+	})
+
+	return hasDefer
+}
+
+// groupBlocker returns the position and a description of a statement or a use of testVar, the
+// *testing.T of decl, in r, a loop of decl, that would behave differently in the group subtest:
+// a return, a defer statement or a branch statement with a label or goto, which would leave the
+// function of the group instead of the test, or testVar other than calling Run, such as t.Fatal(),
+// which would refer to the group.
+func groupBlocker(decl *ast.FuncDecl, r *ast.RangeStmt, testVar string) (token.Pos, string, bool) {
+	var testObj *ast.Object
+
+	for _, field := range decl.Type.Params.List {
+		for _, name := range field.Names {
+			if name.Name == testVar {
+				testObj = name.Obj
+			}
+		}
+	}
+
+	// The receivers of the Run calls, which the group runs its subtests with.
+	runs := map[*ast.Ident]bool{}
+
+	ast.Inspect(r.Body, func(n ast.Node) bool {
+		if call, ok := n.(*ast.CallExpr); ok && hasRunMethod(call, testVar) {
+			if id, ok := call.Fun.(*ast.SelectorExpr).X.(*ast.Ident); ok {
+				runs[id] = true
+			}
+		}
+
+		return true
+	})
+
+	var (
+		blocker ast.Node
+		desc    string
+	)
+
+	// The statements of the function literals belong to them.
+	var inspect func(inFunc bool) func(n ast.Node) bool
+	inspect = func(inFunc bool) func(n ast.Node) bool {
+		return func(n ast.Node) bool {
+			if blocker != nil {
+				return false
+			}
+
+			switch n := n.(type) {
+			case *ast.FuncLit:
+				ast.Inspect(n.Body, inspect(true))
+
+				return false
+			case *ast.ReturnStmt:
+				if !inFunc {
+					blocker, desc = n, "a return statement"
+				}
+			case *ast.DeferStmt:
+				if !inFunc {
+					blocker, desc = n, "a defer statement"
+				}
+			case *ast.BranchStmt:
+				if !inFunc && (n.Label != nil || n.Tok == token.GOTO) {
+					blocker, desc = n, nodeString(n)
+				}
+			case *ast.Ident:
+				if testObj != nil && n.Obj == testObj && !runs[n] {
+					blocker, desc = n, "a use of "+testVar+" other than Run"
+				}
+			}
+
+			return blocker == nil
+		}
+	}
+
+	ast.Inspect(r.Body, inspect(false))
+
+	if blocker == nil {
+		return token.NoPos, "", false
+	}
+
+	return blocker.Pos(), desc, true
+}
+
+// groupSubtests replaces r, a statement of decl, with the group subtest wrapping it, and returns
+// the body of the group. testVar is the *testing.T of decl, an identifier.
+func (s *pkgScope) groupSubtests(f *ast.File, rv *reviewer, decl *ast.FuncDecl, r *ast.RangeStmt, testVar string) (*ast.BlockStmt, bool) {
+	if !token.IsIdentifier(testVar) {
+		// e.g. s.T() of a test suite, which the group cannot shadow.
+		return nil, false
+	}
+
+	group := buildGroupStmt(r, testVar, s.fileOf(decl.Pos()).testingName)
+	if !rv.accept(f, decl, EditGroup, nil, r.Pos(), group) {
+		return nil, false
+	}
+
+	for i, stmt := range decl.Body.List {
+		if stmt == r {
+			decl.Body.List[i] = group
+		}
+	}
+
+	fun, _ := group.X.(*ast.CallExpr).Args[1].(*ast.FuncLit)
+
+	return fun.Body, true
+}
+
+// buildGroupStmt returns the statement running r in the group subtest,
+// testVar.Run("group", func(testVar *testing.T) { r }).
+func buildGroupStmt(r *ast.RangeStmt, testVar, testingName string) *ast.ExprStmt {
+	pos := r.Pos()
+
+	fun := &ast.FuncLit{
+		Type: &ast.FuncType{
+			Func: pos,
+			Params: &ast.FieldList{
+				Opening: pos,
+				List: []*ast.Field{{
+					Names: []*ast.Ident{{NamePos: pos, Name: testVar}},
+					Type: &ast.StarExpr{
+						Star: pos,
+						X: &ast.SelectorExpr{
+							X:   &ast.Ident{NamePos: pos, Name: testingName},
+							Sel: &ast.Ident{NamePos: pos, Name: testMethodStruct},
+						},
+					},
+				}},
+				Closing: pos,
+			},
+		},
+		Body: &ast.BlockStmt{
+			Lbrace: pos,
+			List:   []ast.Stmt{r},
+			Rbrace: r.End(),
+		},
+	}
+
+	return &ast.ExprStmt{
+		X: &ast.CallExpr{
+			Fun: &ast.SelectorExpr{
+				X:   &ast.Ident{NamePos: pos, Name: testVar},
+				Sel: &ast.Ident{NamePos: pos, Name: "Run"},
+			},
+			Lparen: pos,
+			Args: []ast.Expr{
+				&ast.BasicLit{ValuePos: pos, Kind: token.STRING, Value: strconv.Quote(groupSubtestName)},
+				fun,
+			},
+			Rparen: r.End(),
+		},
+	}
+}
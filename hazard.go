@@ -0,0 +1,368 @@
+package tparagen
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// processGlobalFuncs are the functions that change process-wide state, so tests
+// calling them must not run in parallel with other tests.
+// key: import path, value: function names
+var processGlobalFuncs = map[string][]string{
+	"flag":          {"Set", "Parse"},
+	"log":           {"SetOutput", "SetFlags", "SetPrefix", "SetDefault"},
+	"log/slog":      {"SetDefault", "SetLogLoggerLevel"},
+	"math/rand":     {"Seed"},
+	"net/http":      {"Handle", "HandleFunc"},
+	"os":            {"Setenv", "Unsetenv", "Clearenv", "Chdir"},
+	"runtime":       {"GOMAXPROCS"},
+	"runtime/debug": {"SetGCPercent", "SetMaxStack", "SetMaxThreads", "SetMemoryLimit"},
+	"syscall":       {"Setenv", "Unsetenv", "Clearenv", "Chdir"},
+}
+
+// setenvLikeFuncs are the functions that, like t.Setenv, make the test or subtest
+// calling them directly unable to run in parallel.
+// key: import path, value: function names
+var setenvLikeFuncs = map[string][]string{
+	"os": {"Setenv", "Unsetenv", "Chdir"},
+}
+
+// hazard is a use of shared state in a test that makes it unsafe to run in parallel.
+type hazard struct {
+	pos     token.Pos
+	message string
+}
+
+// pkgScope is what the analyses know about the package of the file being processed.
+type pkgScope struct {
+	fs *token.FileSet
+	// files are the scopes of the files of the package.
+	files map[*token.File]*fileScope
+	// vars is the set of package-level variable names.
+	vars map[string]bool
+	// funcs are the package-level functions by name.
+	funcs map[string]*ast.FuncDecl
+	// names is the set of the package-level names: constants, types, variables and functions.
+	names map[string]bool
+	// topLevel is the set of package-level declarations: *ast.ValueSpec and *ast.FuncDecl.
+	topLevel map[any]bool
+
+	// incompatible are the user-defined functions that, like t.Setenv, make the test
+	// or subtest calling them unable to run in parallel.
+	incompatible *funcSet
+	// parallelHelpers are the user-defined functions that count as calling Parallel()
+	// on their *testing.T argument.
+	parallelHelpers *funcSet
+	// detectHelpers enables the detection of the parallel helpers of the imported packages.
+	detectHelpers bool
+
+	// info is the type information of the package. It is nil unless an analysis needs it.
+	info *types.Info
+	// importer imported the packages of info.
+	importer *moduleImporter
+}
+
+// fileScope is what the analyses know about a file of the package.
+type fileScope struct {
+	ast *ast.File
+	// imports maps the names of the imported packages to their import paths.
+	imports map[string]string
+	// dotImports are the import paths of the packages imported with a dot.
+	dotImports []string
+	// testingName is the name the testing package is imported as.
+	testingName string
+}
+
+// newPkgScope returns the scope of the package made of files, parsed with fs.
+func newPkgScope(fs *token.FileSet, files ...*ast.File) *pkgScope {
+	s := &pkgScope{
+		fs:       fs,
+		files:    map[*token.File]*fileScope{},
+		vars:     map[string]bool{},
+		funcs:    map[string]*ast.FuncDecl{},
+		names:    map[string]bool{},
+		topLevel: map[any]bool{},
+	}
+
+	for _, f := range files {
+		s.files[fs.File(f.Pos())] = newFileScope(f)
+
+		for _, decl := range f.Decls {
+			switch decl := decl.(type) {
+			case *ast.GenDecl:
+				for _, spec := range decl.Specs {
+					switch spec := spec.(type) {
+					case *ast.TypeSpec:
+						s.names[spec.Name.Name] = true
+					case *ast.ValueSpec:
+						for _, name := range spec.Names {
+							s.names[name.Name] = true
+						}
+					}
+				}
+
+				if decl.Tok != token.VAR {
+					continue
+				}
+
+				for _, spec := range decl.Specs {
+					s.topLevel[spec] = true
+					for _, name := range spec.(*ast.ValueSpec).Names {
+						// e.g. var _ io.Reader = (*reader)(nil)
+						if name.Name != "_" {
+							s.vars[name.Name] = true
+						}
+					}
+				}
+			case *ast.FuncDecl:
+				if decl.Recv == nil {
+					s.topLevel[decl] = true
+					s.funcs[decl.Name.Name] = decl
+					s.names[decl.Name.Name] = true
+				}
+			}
+		}
+	}
+
+	return s
+}
+
+func newFileScope(f *ast.File) *fileScope {
+	scope := &fileScope{ast: f, imports: map[string]string{}}
+	scope.testingName, _ = testingImportName(f)
+
+	for _, spec := range f.Imports {
+		p, err := strconv.Unquote(spec.Path.Value)
+		if err != nil {
+			continue
+		}
+
+		name := importName(p)
+		if spec.Name != nil {
+			name = spec.Name.Name
+		}
+
+		if name == "." {
+			scope.dotImports = append(scope.dotImports, p)
+
+			continue
+		}
+
+		scope.imports[name] = p
+	}
+
+	return scope
+}
+
+// fileOf returns the scope of the file containing pos.
+func (s *pkgScope) fileOf(pos token.Pos) *fileScope {
+	if scope, ok := s.files[s.fs.File(pos)]; ok {
+		return scope
+	}
+
+	return &fileScope{}
+}
+
+// importName returns the default name of the package imported by import path p, assuming the
+// package name matches the import path, ignoring a major version suffix like "/v2".
+func importName(p string) string {
+	name := path.Base(p)
+	// e.g. github.com/alecthomas/kingpin/v2
+	if strings.HasPrefix(name, "v") {
+		if _, err := strconv.Atoi(name[1:]); err == nil && path.Dir(p) != "." {
+			name = path.Base(path.Dir(p))
+		}
+	}
+
+	// e.g. github.com/acme/go-testenv
+	return strings.NewReplacer("-", "_", ".", "_").Replace(name)
+}
+
+// isGlobal reports whether id refers to a package-level identifier rather than a local one.
+// The parser resolves the identifiers declared in the file; the others are left unresolved.
+func (s *pkgScope) isGlobal(id *ast.Ident) bool {
+	if id.Obj == nil {
+		return true
+	}
+
+	return s.topLevel[id.Obj.Decl]
+}
+
+// pkgVar returns the package-level variable name of id, if it refers to one.
+func (s *pkgScope) pkgVar(id *ast.Ident) (string, bool) {
+	if !s.vars[id.Name] || !s.isGlobal(id) {
+		return "", false
+	}
+
+	return id.Name, true
+}
+
+// importedPkg returns the import path of the package referred to by id, if it refers to one.
+func (s *pkgScope) importedPkg(id *ast.Ident) (string, bool) {
+	if id.Obj != nil {
+		return "", false
+	}
+
+	p, ok := s.fileOf(id.Pos()).imports[id.Name]
+
+	return p, ok
+}
+
+// calledFunc returns the import path and the name of the function called by call.
+// The import path is empty for the functions of the package itself.
+func (s *pkgScope) calledFunc(call *ast.CallExpr) (string, string, bool) {
+	switch fun := call.Fun.(type) {
+	case *ast.Ident:
+		if _, ok := s.funcs[fun.Name]; ok && s.isGlobal(fun) {
+			return "", fun.Name, true
+		}
+	case *ast.SelectorExpr:
+		if x, ok := fun.X.(*ast.Ident); ok {
+			if p, ok := s.importedPkg(x); ok {
+				return p, fun.Sel.Name, true
+			}
+		}
+	}
+
+	return "", "", false
+}
+
+// findHazards returns the uses of shared state in body, including the package
+// functions it calls directly or indirectly.
+func (s *pkgScope) findHazards(body *ast.BlockStmt) []hazard {
+	var hazards []hazard
+
+	visited := map[*ast.FuncDecl]bool{}
+
+	var inspect func(n ast.Node, via string)
+	inspect = func(n ast.Node, via string) {
+		ast.Inspect(n, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.AssignStmt:
+				if n.Tok == token.DEFINE {
+					return true
+				}
+
+				for _, lhs := range n.Lhs {
+					if h, ok := s.writeHazard(lhs, via); ok {
+						hazards = append(hazards, h)
+					}
+				}
+			case *ast.IncDecStmt:
+				if h, ok := s.writeHazard(n.X, via); ok {
+					hazards = append(hazards, h)
+				}
+			case *ast.CallExpr:
+				p, name, ok := s.calledFunc(n)
+				if !ok {
+					return true
+				}
+
+				if p == "" {
+					helper := s.funcs[name]
+					if !visited[helper] && helper.Body != nil {
+						visited[helper] = true
+						inspect(helper.Body, name)
+					}
+
+					return true
+				}
+
+				// Direct calls of the functions like t.Setenv are handled per test and subtest.
+				if via == "" && containsFunc(setenvLikeFuncs, p, name) {
+					return true
+				}
+
+				if containsFunc(processGlobalFuncs, p, name) {
+					hazards = append(hazards, hazard{
+						pos:     n.Pos(),
+						message: withVia(fmt.Sprintf("calls %s.%s, which changes process-wide state", importName(p), name), via),
+					})
+				}
+			}
+
+			return true
+		})
+	}
+
+	inspect(body, "")
+
+	return hazards
+}
+
+// writeHazard returns a hazard if lhs, the target of an assignment, is a package-level variable
+// of this or another package, or a part of one.
+func (s *pkgScope) writeHazard(lhs ast.Expr, via string) (hazard, bool) {
+	for {
+		switch e := lhs.(type) {
+		case *ast.Ident:
+			// Assigning to the blank identifier writes nothing.
+			if e.Name == "_" {
+				return hazard{}, false
+			}
+
+			if name, ok := s.pkgVar(e); ok {
+				return hazard{pos: e.Pos(), message: withVia("writes package-level variable "+name, via)}, true
+			}
+
+			return hazard{}, false
+		case *ast.SelectorExpr:
+			if x, ok := e.X.(*ast.Ident); ok {
+				if p, ok := s.importedPkg(x); ok {
+					return hazard{pos: e.Pos(), message: withVia(fmt.Sprintf("writes package-level variable %s.%s", importName(p), e.Sel.Name), via)}, true
+				}
+			}
+
+			lhs = e.X
+		case *ast.IndexExpr:
+			lhs = e.X
+		case *ast.StarExpr:
+			lhs = e.X
+		case *ast.ParenExpr:
+			lhs = e.X
+		default:
+			return hazard{}, false
+		}
+	}
+}
+
+// hasSetenvCall reports whether node calls testVar.Setenv() or one of the functions like it.
+func (s *pkgScope) hasSetenvCall(node ast.Node, testVar string) bool {
+	if hasSetenvMethod(node, testVar) {
+		return true
+	}
+
+	call, ok := node.(*ast.CallExpr)
+	if !ok {
+		return false
+	}
+
+	if p, name, ok := s.calledFunc(call); ok && containsFunc(setenvLikeFuncs, p, name) {
+		return true
+	}
+
+	return s.incompatible.containsCall(s, call)
+}
+
+func containsFunc(funcs map[string][]string, importPath, name string) bool {
+	for _, f := range funcs[importPath] {
+		if f == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func withVia(message, via string) string {
+	if via == "" {
+		return message
+	}
+
+	return fmt.Sprintf("%s (via %s)", message, via)
+}
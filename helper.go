@@ -0,0 +1,165 @@
+package tparagen
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"strconv"
+)
+
+// isTestingTType reports whether expr is *testing.T or testing.TB, where testingName
+// is the name the testing package is imported as.
+func isTestingTType(expr ast.Expr, testingName string) bool {
+	if star, ok := expr.(*ast.StarExpr); ok {
+		return isSelector(star.X, testingName, testMethodStruct)
+	}
+
+	return isSelector(expr, testingName, "TB")
+}
+
+func isSelector(expr ast.Expr, x, sel string) bool {
+	s, ok := expr.(*ast.SelectorExpr)
+	if !ok {
+		return false
+	}
+
+	id, ok := s.X.(*ast.Ident)
+
+	return ok && id.Name == x && s.Sel.Name == sel
+}
+
+// testingImportName returns the name the testing package is imported as in f.
+func testingImportName(f *ast.File) (string, bool) {
+	for _, spec := range f.Imports {
+		if p, err := strconv.Unquote(spec.Path.Value); err != nil || p != testMethodPackageType {
+			continue
+		}
+
+		if spec.Name != nil {
+			return spec.Name.Name, true
+		}
+
+		return testMethodPackageType, true
+	}
+
+	return "", false
+}
+
+// parallelHelperParam returns the index of the *testing.T or testing.TB parameter of decl
+// on which its body unconditionally calls Parallel(), if any.
+func parallelHelperParam(decl *ast.FuncDecl, testingName string) (int, bool) {
+	if decl.Body == nil || decl.Type.Params == nil {
+		return 0, false
+	}
+
+	var index int
+
+	for _, field := range decl.Type.Params.List {
+		names := len(field.Names)
+		if names == 0 {
+			names = 1
+		}
+
+		if isTestingTType(field.Type, testingName) {
+			for i, name := range field.Names {
+				// Only the statements directly in the body are run unconditionally.
+				for _, stmt := range decl.Body.List {
+					if s, ok := stmt.(*ast.ExprStmt); ok && hasParallelMethod(s.X, name.Name) {
+						return index + i, true
+					}
+				}
+			}
+		}
+
+		index += names
+	}
+
+	return 0, false
+}
+
+// externalParallelHelperParam returns the index of the parameter of f, a function of a package
+// imported by m, on which it unconditionally calls Parallel(), if any.
+// The declaration of f is read from the source the package was type-checked from.
+func (m *moduleImporter) externalParallelHelperParam(f *types.Func) (int, bool) {
+	if v, ok := m.helpers.Load(f); ok {
+		index, _ := v.(int)
+
+		return index, index >= 0
+	}
+
+	index := -1
+
+	pos := m.fset.Position(f.Pos())
+	if pos.IsValid() {
+		fs := token.NewFileSet()
+		if file, err := parser.ParseFile(fs, pos.Filename, nil, 0); err == nil {
+			if testingName, ok := testingImportName(file); ok {
+				for _, decl := range file.Decls {
+					d, ok := decl.(*ast.FuncDecl)
+					if !ok || fs.Position(d.Name.Pos()).Offset != pos.Offset {
+						continue
+					}
+
+					if i, ok := parallelHelperParam(d, testingName); ok {
+						index = i
+					}
+				}
+			}
+		}
+	}
+
+	m.helpers.Store(f, index)
+
+	return index, index >= 0
+}
+
+// hasParallelCall reports whether node calls testVar.Parallel() or a parallel helper with testVar.
+// The parallel helpers are the functions given by the user, the functions of the package that
+// unconditionally call Parallel() on their *testing.T parameter, and, if the type information is
+// available and detectHelpers is set, such functions of the imported packages.
+func (s *pkgScope) hasParallelCall(node ast.Node, testVar string) bool {
+	if hasParallelMethod(node, testVar) {
+		return true
+	}
+
+	call, ok := node.(*ast.CallExpr)
+	if !ok {
+		return false
+	}
+
+	argIndex := -1
+	for i, arg := range call.Args {
+		if types.ExprString(arg) == testVar {
+			argIndex = i
+		}
+	}
+
+	if argIndex < 0 {
+		return false
+	}
+
+	if s.parallelHelpers.containsCall(s, call) {
+		return true
+	}
+
+	if p, name, ok := s.calledFunc(call); ok && p == "" {
+		decl := s.funcs[name]
+		index, ok := parallelHelperParam(decl, s.fileOf(decl.Pos()).testingName)
+
+		return ok && index == argIndex
+	}
+
+	if s.info == nil || !s.detectHelpers {
+		return false
+	}
+
+	f, ok := calledFuncObj(s.info, call)
+	if !ok || f.Pkg() == nil || f.Signature().Recv() != nil {
+		return false
+	}
+
+	index, ok := s.importer.externalParallelHelperParam(f)
+
+	return ok && index == argIndex
+}
@@ -0,0 +1,102 @@
+package tparagen
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// contextLines is the number of source lines shown around a proposed edit.
+const contextLines = 3
+
+// prompter asks the user whether to insert each statement proposed by GenerateTParallel.
+type prompter struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+func newPrompter(in io.Reader, out io.Writer) *prompter {
+	return &prompter{in: bufio.NewReader(in), out: out}
+}
+
+// filter returns an edit filter for the test file at path with the contents src.
+// When no more answers can be read, the rest of the file is skipped.
+func (p *prompter) filter(path string, src []byte) func(Edit) Decision {
+	lines := strings.Split(string(src), "\n")
+
+	return func(e Edit) Decision {
+		p.show(path, lines, e)
+
+		for {
+			fmt.Fprint(p.out, "Insert? [y]es, [n]o, [s]kip rest of file, [o]pt out function: ")
+
+			answer, err := p.in.ReadString('\n')
+			switch strings.ToLower(strings.TrimSpace(answer)) {
+			case "y", "yes":
+				return Accept
+			case "n", "no":
+				return Skip
+			case "s", "skip":
+				return SkipFile
+			case "o", "opt-out":
+				return OptOut
+			}
+
+			if err != nil {
+				fmt.Fprintln(p.out)
+
+				return SkipFile
+			}
+		}
+	}
+}
+
+// show prints the proposed edit with the surrounding source lines.
+func (p *prompter) show(path string, lines []string, e Edit) {
+	target := e.Func
+	if e.Subtest != "" {
+		target = fmt.Sprintf("subtest %s of %s", e.Subtest, e.Func)
+	}
+
+	if e.Kind == EditGroup {
+		// The statement is the whole loop in the group.
+		fmt.Fprintf(p.out, "\n%s:%d: wrap the loop in a group subtest of %s\n", path, e.Pos.Line, target)
+
+		for _, line := range strings.Split(e.Stmt, "\n") {
+			fmt.Fprintf(p.out, "    +  %s%s\n", indentOf(lines[e.Pos.Line-1]), line)
+		}
+
+		return
+	}
+
+	replace := e.Kind == EditDeferToCleanup
+	if replace {
+		fmt.Fprintf(p.out, "\n%s:%d: replace the statement with %s in %s\n", path, e.Pos.Line, e.Stmt, target)
+	} else {
+		fmt.Fprintf(p.out, "\n%s:%d: insert %s into %s\n", path, e.Pos.Line, e.Stmt, target)
+	}
+
+	// The statement is inserted right after the line of the opening brace,
+	// or replaces the statement on the line.
+	start, end := max(e.Pos.Line-contextLines, 1), min(e.Pos.Line+contextLines, len(lines))
+	for i := start; i <= end; i++ {
+		if i == e.Pos.Line && replace {
+			fmt.Fprintf(p.out, "    -  %s\n", lines[i-1])
+			fmt.Fprintf(p.out, "    +  %s%s\n", indentOf(lines[i-1]), e.Stmt)
+
+			continue
+		}
+
+		fmt.Fprintf(p.out, "%5d  %s\n", i, lines[i-1])
+
+		if i == e.Pos.Line {
+			fmt.Fprintf(p.out, "    +  \t%s\n", e.Stmt)
+		}
+	}
+}
+
+// indentOf returns the leading white space of line.
+func indentOf(line string) string {
+	return line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+}
@@ -0,0 +1,210 @@
+package tparagen
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// WithPackageFiles gives GenerateTParallel the other files of the package of the file, keyed by
+// their paths, so that the analyses see the helpers and package-level variables declared there.
+// The files of another package, such as the external test package in the same directory, are ignored.
+func WithPackageFiles(files map[string][]byte) GenerateOption {
+	return func(o *generateOptions) {
+		o.packageFiles = files
+	}
+}
+
+// withParsedPackageFiles makes GenerateTParallel take the files given by WithPackageFiles from
+// files, which parses them once for all the files of the package processed.
+func withParsedPackageFiles(files *parsedFiles) GenerateOption {
+	return func(o *generateOptions) {
+		o.parsedFiles = files
+	}
+}
+
+// packageFiles returns the options giving GenerateTParallel the other Go files in the directory
+// of path. GenerateTParallel picks those of the same package from them.
+func (t *tparagen) packageFiles(path string) ([]GenerateOption, error) {
+	parsed, err := t.dirFiles.get(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+
+	others := make(map[string][]byte, len(parsed.srcs))
+	for p, src := range parsed.srcs {
+		if p != filepath.Clean(path) {
+			others[p] = src
+		}
+	}
+
+	return []GenerateOption{WithPackageFiles(others), withParsedPackageFiles(parsed)}, nil
+}
+
+// parsedFiles parses the Go files of a directory at most once each, for all the files of the
+// directory processed. They share its file set, into which the files processed are parsed too.
+type parsedFiles struct {
+	fs *token.FileSet
+	// srcs are the contents of the files, keyed by their paths.
+	srcs  map[string][]byte
+	parse map[string]func() (*ast.File, error)
+}
+
+func newParsedFiles(srcs map[string][]byte) *parsedFiles {
+	p := &parsedFiles{fs: token.NewFileSet(), srcs: srcs, parse: make(map[string]func() (*ast.File, error), len(srcs))}
+
+	for path, src := range srcs {
+		p.parse[path] = sync.OnceValues(func() (*ast.File, error) {
+			return parser.ParseFile(p.fs, path, src, parser.ParseComments)
+		})
+	}
+
+	return p
+}
+
+// file returns the file at path parsed.
+func (p *parsedFiles) file(path string) (*ast.File, error) {
+	parse, ok := p.parse[path]
+	if !ok {
+		return nil, fmt.Errorf("%s is not in the directory. %w", path, fs.ErrNotExist)
+	}
+
+	return parse()
+}
+
+// dirFileCache caches the Go files of the directories, so that the files of a directory are
+// read and parsed once for all its test files processed around the same time. The directories
+// used least recently are evicted once the sources kept exceed limit; they are read again if
+// needed. The parsed files, kept along with them, take several times the size of the sources.
+// The zero value is ready to use.
+type dirFileCache struct {
+	// limit is the total size of the files kept. Zero means dirFilesMemoryLimit.
+	limit int64
+
+	mu sync.Mutex
+	// entries are the directories cached, by path.
+	entries map[string]*dirFiles
+	// size is the total size of the files of entries.
+	size int64
+	// clock orders the uses of the entries.
+	clock int64
+}
+
+type dirFiles struct {
+	read func() (*parsedFiles, error)
+	size int64
+	// used is the clock of the last use.
+	used int64
+}
+
+// get returns the Go files in dir.
+func (c *dirFileCache) get(dir string) (*parsedFiles, error) {
+	c.mu.Lock()
+
+	if c.entries == nil {
+		c.entries = map[string]*dirFiles{}
+	}
+
+	e, ok := c.entries[dir]
+	if !ok {
+		e = &dirFiles{read: sync.OnceValues(func() (*parsedFiles, error) {
+			srcs, err := readGoFiles(dir)
+			if err != nil {
+				return nil, err
+			}
+
+			return newParsedFiles(srcs), nil
+		})}
+		c.entries[dir] = e
+	}
+
+	c.clock++
+	e.used = c.clock
+	c.mu.Unlock()
+
+	files, err := e.read()
+	if err != nil || ok {
+		return files, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, src := range files.srcs {
+		e.size += int64(len(src))
+	}
+
+	c.size += e.size
+	c.evict(e)
+
+	return files, nil
+}
+
+// evict removes the entries used least recently, except keep, until the size is within the limit.
+func (c *dirFileCache) evict(keep *dirFiles) {
+	limit := c.limit
+	if limit == 0 {
+		limit = dirFilesMemoryLimit
+	}
+
+	for c.size > limit {
+		var (
+			oldestDir string
+			oldest    *dirFiles
+		)
+
+		for dir, e := range c.entries {
+			if e != keep && (oldest == nil || e.used < oldest.used) {
+				oldestDir, oldest = dir, e
+			}
+		}
+
+		if oldest == nil {
+			return
+		}
+
+		delete(c.entries, oldestDir)
+		c.size -= oldest.size
+	}
+}
+
+// readGoFiles returns the Go files in dir keyed by their paths, ignoring the files
+// the go command ignores, whose names begin with "." or "_".
+func readGoFiles(dir string) (map[string][]byte, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		// e.g. an unsaved file in a new directory given to Filter.
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s. %w", dir, err)
+	}
+
+	files := map[string][]byte{}
+
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, ".go") || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") {
+			continue
+		}
+
+		p := filepath.Join(dir, name)
+
+		src, err := os.ReadFile(p)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read %s. %w", p, err)
+		}
+
+		files[p] = src
+	}
+
+	return files, nil
+}
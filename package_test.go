@@ -0,0 +1,81 @@
+package tparagen
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDirFileCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	t.Parallel()
+
+	dirs := make([]string, 3)
+	for i := range dirs {
+		dirs[i] = t.TempDir()
+
+		if err := os.WriteFile(filepath.Join(dirs[i], "a_test.go"), []byte("package a\n"), 0o600); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+	}
+
+	// Two directories fit in the limit.
+	c := dirFileCache{limit: 2 * int64(len("package a\n"))}
+
+	for _, dir := range []string{dirs[0], dirs[1], dirs[0], dirs[2]} {
+		files, err := c.get(dir)
+		if err != nil {
+			t.Fatalf("get() returned error: %v", err)
+		}
+
+		if got := string(files.srcs[filepath.Join(dir, "a_test.go")]); got != "package a\n" {
+			t.Errorf("get(%q) returned %q", dir, got)
+		}
+	}
+
+	if _, ok := c.entries[dirs[1]]; ok {
+		t.Errorf("the least recently used directory is still cached")
+	}
+
+	if len(c.entries) != 2 || c.size != c.limit {
+		t.Errorf("cached %d directories of %d bytes, want 2 of %d bytes", len(c.entries), c.size, c.limit)
+	}
+}
+
+func TestPackageFilesParsedOnce(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	for _, name := range []string{"a_test.go", "b_test.go", "helpers_test.go"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("package a\n"), 0o600); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+	}
+
+	r := newRunner(dir)
+	helpers := filepath.Join(dir, "helpers_test.go")
+
+	var options []*generateOptions
+
+	for _, name := range []string{"a_test.go", "b_test.go"} {
+		opts, err := r.packageFiles(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("packageFiles() returned error: %v", err)
+		}
+
+		o := newGenerateOptions(opts...)
+		if _, ok := o.packageFiles[filepath.Join(dir, name)]; ok {
+			t.Errorf("the files of %s include itself", name)
+		}
+
+		options = append(options, o)
+	}
+
+	a, err := options[0].parsePackageFile(nil, helpers)
+	if err != nil {
+		t.Fatalf("failed to parse %s: %v", helpers, err)
+	}
+
+	if b, _ := options[1].parsePackageFile(nil, helpers); a != b {
+		t.Errorf("%s was parsed again for another file of the package", helpers)
+	}
+}
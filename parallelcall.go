@@ -0,0 +1,208 @@
+package tparagen
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"maps"
+	"path"
+	"strconv"
+	"strings"
+
+	"golang.org/x/tools/go/ast/astutil"
+)
+
+// testVarPlaceholder is replaced with the *testing.T variable in the argument list
+// of a parallel call template.
+const testVarPlaceholder = "$t"
+
+// testVarIdent is the identifier testVarPlaceholder is parsed as.
+const testVarIdent = "tparagenTestVar__"
+
+// parallelCall is the call of a package-level function inserted instead of t.Parallel(),
+// such as "github.com/acme/testenv.Parallel($t)".
+type parallelCall struct {
+	// path is the import path of the package of the function.
+	path string
+	// name is the name of the function.
+	name string
+	// args are the arguments. testVarPlaceholder stands for the *testing.T variable,
+	// the others are identifiers or literals.
+	args []ast.Expr
+}
+
+// parseParallelCall parses a call template such as "github.com/acme/testenv.Parallel($t)".
+func parseParallelCall(template string) (*parallelCall, error) {
+	tmpl := strings.TrimSpace(template)
+
+	fun, args, ok := strings.Cut(tmpl, "(")
+	if !ok || !strings.HasSuffix(args, ")") {
+		return nil, fmt.Errorf("invalid parallel call %q: want import/path.Func(args)", template)
+	}
+
+	slash := strings.LastIndex(fun, "/")
+	dot := strings.LastIndex(fun, ".")
+	if dot <= slash+1 || dot == len(fun)-1 || !token.IsIdentifier(fun[dot+1:]) {
+		return nil, fmt.Errorf("invalid parallel call %q: want import/path.Func(args)", template)
+	}
+
+	c := &parallelCall{path: fun[:dot], name: fun[dot+1:]}
+
+	// The arguments are parsed as those of a Go call, where the placeholder stands for an identifier.
+	call, ok := parseExpr("f(" + strings.ReplaceAll(args, testVarPlaceholder, testVarIdent)).(*ast.CallExpr)
+	if !ok || call.Ellipsis.IsValid() {
+		return nil, fmt.Errorf("invalid parallel call %q: want import/path.Func(args)", template)
+	}
+
+	var hasTestVar bool
+
+	for _, arg := range call.Args {
+		switch e := arg.(type) {
+		case *ast.Ident:
+			if e.Name == testVarIdent {
+				hasTestVar = true
+				c.args = append(c.args, &ast.Ident{Name: testVarPlaceholder})
+
+				continue
+			}
+
+			// e.g. $tx
+			if strings.Contains(e.Name, testVarIdent) {
+				return nil, fmt.Errorf("invalid parallel call %q: argument %q is neither %s, an identifier nor a literal",
+					template, strings.ReplaceAll(e.Name, testVarIdent, testVarPlaceholder), testVarPlaceholder)
+			}
+
+			c.args = append(c.args, &ast.Ident{Name: e.Name})
+		case *ast.BasicLit:
+			c.args = append(c.args, &ast.BasicLit{Kind: e.Kind, Value: strings.ReplaceAll(e.Value, testVarIdent, testVarPlaceholder)})
+		default:
+			return nil, fmt.Errorf("invalid parallel call %q: argument %q is neither %s, an identifier nor a literal",
+				template, strings.ReplaceAll(nodeString(arg), testVarIdent, testVarPlaceholder), testVarPlaceholder)
+		}
+	}
+
+	if !hasTestVar {
+		return nil, fmt.Errorf("invalid parallel call %q: no %s argument", template, testVarPlaceholder)
+	}
+
+	return c, nil
+}
+
+func parseExpr(s string) ast.Expr {
+	e, err := parser.ParseExpr(s)
+	if err != nil {
+		return nil
+	}
+
+	return e
+}
+
+// funcName returns the fully-qualified name of the function, as accepted by parseFuncSet.
+func (c *parallelCall) funcName() string {
+	return c.path + "." + c.name
+}
+
+// String returns the template c was parsed from, in its canonical form.
+func (c *parallelCall) String() string {
+	args := make([]string, len(c.args))
+	for i, arg := range c.args {
+		args[i] = nodeString(arg)
+	}
+
+	return fmt.Sprintf("%s(%s)", c.funcName(), strings.Join(args, ", "))
+}
+
+// build returns the statement calling the function with testVar at pos, where pkgName
+// is the name the package is imported as.
+func (c *parallelCall) build(pos token.Pos, pkgName, testVar string) *ast.ExprStmt {
+	args := make([]ast.Expr, len(c.args))
+	for i, arg := range c.args {
+		switch arg := arg.(type) {
+		case *ast.Ident:
+			if arg.Name == testVarPlaceholder {
+				args[i] = buildTestExpr(pos, testVar)
+
+				continue
+			}
+
+			args[i] = &ast.Ident{NamePos: pos, Name: arg.Name}
+		case *ast.BasicLit:
+			args[i] = &ast.BasicLit{ValuePos: pos, Kind: arg.Kind, Value: arg.Value}
+		}
+	}
+
+	return &ast.ExprStmt{
+		X: &ast.CallExpr{
+			Fun: &ast.SelectorExpr{
+				X: &ast.Ident{
+					NamePos: pos,
+					Name:    pkgName,
+				},
+				Sel: &ast.Ident{
+					NamePos: pos,
+					Name:    c.name,
+				},
+			},
+			Lparen: pos,
+			Args:   args,
+			Rparen: pos,
+		},
+	}
+}
+
+// importName returns the name to refer to the package of the function in f, a file of the package
+// of scope, and whether the package still has to be imported under it. An existing import of the
+// package is reused; otherwise the package is imported as its default name, or an alias if the name
+// is taken in the file or the package.
+func (c *parallelCall) importName(scope *pkgScope, f *ast.File) (string, bool) {
+	taken := maps.Clone(scope.names)
+
+	for _, spec := range f.Imports {
+		p, err := strconv.Unquote(spec.Path.Value)
+		if err != nil {
+			continue
+		}
+
+		name := importName(p)
+		if spec.Name != nil {
+			name = spec.Name.Name
+		}
+
+		if p == c.path && name != "_" && name != "." {
+			return name, false
+		}
+
+		taken[name] = true
+	}
+
+	// The identifiers declared in the functions of the file.
+	ast.Inspect(f, func(n ast.Node) bool {
+		if id, ok := n.(*ast.Ident); ok && id.Obj != nil {
+			taken[id.Name] = true
+		}
+
+		return true
+	})
+
+	base := importName(c.path)
+	name := base
+
+	for i := 2; taken[name]; i++ {
+		name = base + strconv.Itoa(i)
+	}
+
+	return name, true
+}
+
+// addImport imports the package of the function as name in f. The name is omitted only
+// if it is the last element of the import path, so that it does not rely on a guess.
+func (c *parallelCall) addImport(fs *token.FileSet, f *ast.File, name string) {
+	if name == path.Base(c.path) {
+		astutil.AddImport(fs, f, c.path)
+
+		return
+	}
+
+	astutil.AddNamedImport(fs, f, name, c.path)
+}
@@ -0,0 +1,64 @@
+package tparagen
+
+import "testing"
+
+func TestParseParallelCall(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		template string
+		want     string
+		wantErr  bool
+	}{
+		{template: "github.com/acme/testenv.Parallel($t)", want: "github.com/acme/testenv.Parallel($t)"},
+		{template: " example.com/env.Parallel(ctx,$t, \"db\", 3) ", want: `example.com/env.Parallel(ctx, $t, "db", 3)`},
+		{template: "testenv.Parallel($t)", want: "testenv.Parallel($t)"},
+		{template: `example.com/env.Parallel($t, "a, b", "$t")`, want: `example.com/env.Parallel($t, "a, b", "$t")`},
+		{template: "github.com/acme/testenv.Parallel($tx)", wantErr: true},
+		{template: "github.com/acme/testenv.Parallel($t) + 1", wantErr: true},
+		{template: "github.com/acme/testenv.Parallel()", wantErr: true},
+		{template: "github.com/acme/testenv.Parallel(t)", wantErr: true},
+		{template: "github.com/acme/testenv.Parallel($t, f())", wantErr: true},
+		{template: "github.com/acme/testenv($t)", wantErr: true},
+		{template: "github.com/acme/testenv.Parallel", wantErr: true},
+		{template: "$t.Parallel()", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseParallelCall(tt.template)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseParallelCall(%q) = %v, want error", tt.template, got)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("parseParallelCall(%q) failed: %v", tt.template, err)
+
+			continue
+		}
+
+		if got.String() != tt.want {
+			t.Errorf("parseParallelCall(%q) = %q, want %q", tt.template, got, tt.want)
+		}
+	}
+}
+
+func TestImportName(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]string{
+		"github.com/acme/testenv":    "testenv",
+		"github.com/acme/testenv/v2": "testenv",
+		"github.com/acme/go-testenv": "go_testenv",
+		"v2":                         "v2",
+	}
+
+	for path, want := range tests {
+		if got := importName(path); got != want {
+			t.Errorf("importName(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"go/parser"
 	"go/token"
 	"go/types"
+	"maps"
+	"slices"
 	"strings"
 )
 
@@ -26,8 +28,14 @@ const (
 // Returns:
 // - A byte slice containing the modified source code.
 // - An error if any issues occur during parsing or formatting.
-func GenerateTParallel(filename string, src []byte, needFixLoopVar bool) ([]byte, error) {
+func GenerateTParallel(filename string, src []byte, needFixLoopVar bool, opts ...GenerateOption) ([]byte, error) {
+	o := newGenerateOptions(opts...)
+
 	fs := token.NewFileSet()
+	if o.parsedFiles != nil {
+		// The positions of the files of the package parsed already.
+		fs = o.parsedFiles.fs
+	}
 
 	f, err := parser.ParseFile(fs, filename, src, parser.ParseComments)
 	if err != nil {
@@ -35,16 +43,71 @@ func GenerateTParallel(filename string, src []byte, needFixLoopVar bool) ([]byte
 	}
 
 	if !isTparagenTargetFile(f.Comments) {
+		o.explain(fs, f.Comments[0].Pos(), "", nil, "the file has a nolint directive, not processed")
+
 		return src, nil
 	}
 
-	typesInfo := &types.Info{Defs: map[*ast.Ident]types.Object{}}
+	rv := newReviewer(fs, src, o.editFilter)
+	files := []*ast.File{f}
+
+	// The other files of the package, for the analyses across files.
+	for _, name := range slices.Sorted(maps.Keys(o.packageFiles)) {
+		pf, err := o.parsePackageFile(fs, name)
+		if err != nil || pf.Name.Name != f.Name.Name {
+			continue
+		}
+
+		files = append(files, pf)
+	}
+
+	scope := newPkgScope(fs, files...)
+
+	if scope.incompatible, err = parseFuncSet(o.incompatibleFuncs); err != nil {
+		return nil, err
+	}
+
+	helpers := o.parallelHelpers
+
+	var call *parallelCall
+	if o.parallelCall != "" {
+		if call, err = parseParallelCall(o.parallelCall); err != nil {
+			return nil, err
+		}
+
+		// The configured call counts as a parallel helper.
+		helpers = append(slices.Clone(helpers), call.funcName())
+	}
+
+	if scope.parallelHelpers, err = parseFuncSet(helpers); err != nil {
+		return nil, err
+	}
+
+	scope.detectHelpers = o.detectParallelHelpers
+
+	if scope.incompatible.hasMethods() || scope.parallelHelpers.hasMethods() || scope.detectHelpers {
+		scope.info, scope.importer = typeCheck(fs, files)
+	}
 
 	var (
-		testHasSetenv   bool
-		testHasParallel bool
+		callPkgName      string
+		needImport       bool
+		parallelInserted bool
 	)
 
+	if call != nil {
+		callPkgName, needImport = call.importName(scope, f)
+	}
+
+	// build the statement to insert instead of a missing t.Parallel().
+	buildParallelStmt := func(pos token.Pos, testVar string) *ast.ExprStmt {
+		if call == nil {
+			return buildTParallelStmt(pos, testVar)
+		}
+
+		return call.build(pos, callPkgName, testVar)
+	}
+
 	ast.Inspect(f, func(n ast.Node) bool {
 		funcDecl, ok := n.(*ast.FuncDecl)
 		if !ok {
@@ -53,52 +116,111 @@ func GenerateTParallel(filename string, src []byte, needFixLoopVar bool) ([]byte
 
 		// Check nolint target
 		if !isTparagenTargetFunc(funcDecl.Doc) {
+			if _, isTest := o.testEntryPoint(f, funcDecl); isTest && o.inLineRanges(fs, funcDecl) {
+				o.explain(fs, funcDecl.Doc.Pos(), funcDecl.Name.Name, nil, "has a nolint directive, not parallelised")
+			}
+
+			return true
+		}
+
+		// Check the function is within the lines to be processed
+		if !o.inLineRanges(fs, funcDecl) {
 			return true
 		}
 
 		// Check runs for test functions only
-		isTest, testVar := isTestFunction(funcDecl)
+		testVar, isTest := o.testEntryPoint(f, funcDecl)
 		if !isTest {
 			return true
 		}
 
+		// Check the test does not bootstrap a BDD framework
+		if b, ok := scope.findBDDBootstrap(funcDecl.Body); ok {
+			o.report(fs, b.pos, funcDecl.Name.Name, CategoryBDD, b.message(), !o.insertIntoBDDSuites)
+
+			if !o.insertIntoBDDSuites {
+				return true
+			}
+		}
+
+		// Check the test does not use shared state
+		if hazards := scope.findHazards(funcDecl.Body); len(hazards) > 0 {
+			for _, h := range hazards {
+				o.report(fs, h.pos, funcDecl.Name.Name, CategorySharedState, h.message, !o.insertDespiteHazards)
+			}
+
+			if !o.insertDespiteHazards {
+				return true
+			}
+		}
+
+		var (
+			testHasSetenv   bool
+			testHasParallel bool
+			// testChangesProcess is set if the test calls os.Setenv and the like, whose changes,
+			// unlike those of t.Setenv, are not undone after the subtests.
+			testChangesProcess bool
+		)
+
 		for _, l := range funcDecl.Body.List {
-			if s, ok := l.(*ast.ExprStmt); ok {
-				ast.Inspect(s, func(n ast.Node) bool {
-					// Check if the Run() within the test function is calling t.Parallel
-					if hasRunMethod(n, testVar) {
-						return false
-					}
+			ast.Inspect(l, func(n ast.Node) bool {
+				// Check if the Run() within the test function is calling t.Parallel
+				if hasRunMethod(n, testVar) {
+					return false
+				}
+
+				// The functions with their own *testing.T, such as those of a table of subtests, are checked separately.
+				if fun, ok := n.(*ast.FuncLit); ok && funcParamName(fun) == testVar {
+					return false
+				}
 
-					// Check if the test method is calling Parallel()
-					// If Parallel() is inserted once in a subtest in subsequent processing, `funcHasParallelmethod`  is true.
-					if !testHasParallel {
-						testHasParallel = hasParallelMethod(n, testVar)
+				// Check if the test method is calling Parallel()
+				// If Parallel() is inserted once in a subtest in subsequent processing, `funcHasParallelmethod`  is true.
+				if !testHasParallel {
+					if testHasParallel = scope.hasParallelCall(n, testVar); testHasParallel {
+						o.explain(fs, n.Pos(), funcDecl.Name.Name, nil, "already calls Parallel")
 					}
+				}
 
-					// Check if the test method is calling Setenv()
-					// If Setenv() is inserted once in a subtest in subsequent processing, `funcHasParallelmethod`  is true.
+				// Check if the test method is calling Setenv(), in any statement such as
+				// if err := os.Setenv(k, v); err != nil or defer os.Unsetenv(k).
+				// If Setenv() is inserted once in a subtest in subsequent processing, `funcHasParallelmethod`  is true.
+				if scope.hasSetenvCall(n, testVar) {
 					if !testHasSetenv {
-						testHasSetenv = hasSetenvMethod(n, testVar)
+						o.explain(fs, n.Pos(), funcDecl.Name.Name, nil, fmt.Sprintf("calls %s, not parallelised", nodeString(n.(*ast.CallExpr).Fun)))
 					}
 
-					return true
-				})
-			}
+					testHasSetenv = true
+				}
+
+				if call, ok := n.(*ast.CallExpr); ok {
+					if p, name, ok := scope.calledFunc(call); ok && containsFunc(setenvLikeFuncs, p, name) {
+						testChangesProcess = true
+					}
+				}
+
+				return true
+			})
 		}
 
 		var (
-			rangeStatementOverTestCasesExists,
-			rangeStatementHasParallelMethod,
-			rangeStatementHasSetEnvMethod,
-			loopVarReInitialized bool
-
-			loopVariableUsedInRun *string
+			// The range loops registering subtests, such as the ones over the test cases.
+			loops []*ast.RangeStmt
 
-			rangeNode ast.Node
+			subtests []parallelSubtest
 		)
 
-		for _, l := range funcDecl.Body.List {
+		stmts := funcDecl.Body.List
+
+		// The parallel subtests would run after the test undoes its change, such as with
+		// defer os.Unsetenv(k), and along with the other tests.
+		if testChangesProcess {
+			o.explain(fs, funcDecl.Pos(), funcDecl.Name.Name, nil, "changes the environment or the working directory of the process, its subtests are not parallelised")
+
+			stmts = nil
+		}
+
+		for _, l := range stmts {
 			switch s := l.(type) {
 			case *ast.ExprStmt:
 				ast.Inspect(s, func(n ast.Node) bool {
@@ -107,9 +229,17 @@ func GenerateTParallel(filename string, src []byte, needFixLoopVar bool) ([]byte
 						return true
 					}
 
+					if scope.subtestOptedOut(n.(*ast.CallExpr)) {
+						o.explain(fs, n.Pos(), funcDecl.Name.Name, n.(*ast.CallExpr).Args[0], "has a nolint directive, not parallelised")
+
+						return false
+					}
+
 					// n is a call to t.Run; find out the name of the subtest's *testing.T parameter.
 					innerTestVar := getRunCallbackParameterName(n)
 					if innerTestVar == "" {
+						o.explainCallback(fs, funcDecl, n.(*ast.CallExpr))
+
 						return true
 					}
 
@@ -117,23 +247,32 @@ func GenerateTParallel(filename string, src []byte, needFixLoopVar bool) ([]byte
 
 					ast.Inspect(s, func(p ast.Node) bool {
 						if !subTestHasParallel {
-							subTestHasParallel = hasParallelMethod(p, innerTestVar)
+							subTestHasParallel = scope.hasParallelCall(p, innerTestVar)
 						}
 						if !subTestHasSetEnv {
-							subTestHasSetEnv = hasSetenvMethod(p, innerTestVar)
+							subTestHasSetEnv = scope.hasSetenvCall(p, innerTestVar)
 						}
 
 						return true
 					})
 
+					if subTestHasParallel || subTestHasSetEnv {
+						if fun, ok := n.(*ast.CallExpr).Args[1].(*ast.FuncLit); ok {
+							o.explainSerialSubtest(scope, funcDecl, n.(*ast.CallExpr), fun, innerTestVar)
+						}
+					}
+
 					// Check if the sub test calls t.Parallel.
 					if !subTestHasParallel && !subTestHasSetEnv {
 						if n, ok := n.(*ast.CallExpr); ok {
 							funcArg := n.Args[1]
 							// insert parallel helper method
 							if fun, ok := funcArg.(*ast.FuncLit); ok {
-								tpStmt := buildTParallelStmt(fun.Body.Lbrace, innerTestVar)
-								fun.Body.List = append([]ast.Stmt{tpStmt}, fun.Body.List...)
+								tpStmt := buildParallelStmt(fun.Body.Lbrace, innerTestVar)
+								if rv.accept(f, funcDecl, EditParallel, n, fun.Body.Lbrace, tpStmt) {
+									fun.Body.List = append([]ast.Stmt{tpStmt}, fun.Body.List...)
+									subtests = append(subtests, parallelSubtest{run: n, fun: fun})
+								}
 							}
 						}
 					}
@@ -143,43 +282,18 @@ func GenerateTParallel(filename string, src []byte, needFixLoopVar bool) ([]byte
 
 			// Check if the range over testcases is calling t.Parallel
 			case *ast.RangeStmt:
-				rangeNode = s
-
-				var loopVars []types.Object
-				for _, expr := range []ast.Expr{s.Key, s.Value} {
-					if id, ok := expr.(*ast.Ident); ok {
-						loopVars = append(loopVars, typesInfo.ObjectOf(id))
-					}
+				if registers, serial := rangeSubtests(scope, s, testVar); serial {
+					loops = append(loops, s)
+				} else if registers {
+					o.explain(fs, s.Pos(), funcDecl.Name.Name, nil, "has a loop whose subtests already call Parallel or Setenv, not processed")
 				}
-
+			default:
+				// The subtests registered in the other statements, such as a for loop, are not processed.
 				ast.Inspect(s, func(n ast.Node) bool {
-					switch n := n.(type) {
-					case *ast.ExprStmt:
-						if !hasRunMethod(n.X, testVar) {
-							return true
-						}
-						// e.X is a call to Run(); find out the name of the subtest's *testing.T parameter.
-						innerTestVar := getRunCallbackParameterName(n.X)
+					if call, ok := n.(*ast.CallExpr); ok && hasRunMethod(call, testVar) && len(call.Args) == 2 {
+						o.explain(fs, call.Pos(), funcDecl.Name.Name, call.Args[0], "is not registered directly by the test or in a range loop, not parallelised")
 
-						rangeStatementOverTestCasesExists = true
-
-						if !rangeStatementHasParallelMethod {
-							rangeStatementHasParallelMethod = methodParallelIsCalledInMethodRun(n.X, innerTestVar)
-						}
-
-						if !rangeStatementHasSetEnvMethod {
-							rangeStatementHasSetEnvMethod = methodSetEnvIsCalledInMethodRun(n.X, innerTestVar)
-						}
-
-						if loopVariableUsedInRun == nil {
-							if run, ok := n.X.(*ast.CallExpr); ok {
-								loopVariableUsedInRun = loopVarReferencedInRun(run, loopVars, typesInfo)
-							}
-						}
-					case *ast.AssignStmt:
-						if !loopVarReInitialized {
-							loopVarReInitialized = loopVarReAssigned(n, loopVars, typesInfo)
-						}
+						return false
 					}
 
 					return true
@@ -189,66 +303,228 @@ func GenerateTParallel(filename string, src []byte, needFixLoopVar bool) ([]byte
 
 		// Check if the main test calls Parallel().
 		if !testHasParallel && !testHasSetenv {
-			tpStmt := buildTParallelStmt(funcDecl.Body.Lbrace, testVar)
-			funcDecl.Body.List = append([]ast.Stmt{tpStmt}, funcDecl.Body.List...)
+			tpStmt := buildParallelStmt(funcDecl.Body.Lbrace, testVar)
+			if rv.accept(f, funcDecl, EditParallel, nil, funcDecl.Body.Lbrace, tpStmt) {
+				funcDecl.Body.List = append([]ast.Stmt{tpStmt}, funcDecl.Body.List...)
+				parallelInserted = true
+			}
 		}
 
 		// Check if the sub tests calls t.Parallel.
-		if rangeNode != nil && rangeStatementOverTestCasesExists && !rangeStatementHasParallelMethod && !rangeStatementHasSetEnvMethod {
-			var isInsertedTparallel bool
-
-			ast.Inspect(rangeNode, func(n ast.Node) bool {
-				if isInsertedTparallel {
-					return true
+		for _, r := range loops {
+			group := o.groupSubtests && token.IsIdentifier(testVar) && needsGroup(funcDecl.Body, r)
+			if group {
+				if pos, desc, ok := groupBlocker(funcDecl, r, testVar); ok {
+					o.explain(fs, pos, funcDecl.Name.Name, nil, fmt.Sprintf("has %s in the loop at line %d, which would behave differently in a group subtest, not grouped",
+						desc, fs.Position(r.Pos()).Line))
+
+					group = false
 				}
+			}
 
-				if r, ok := rangeNode.(*ast.RangeStmt); ok {
-					for _, n := range r.Body.List {
-						if e, ok := n.(*ast.ExprStmt); ok {
-							if !hasRunMethod(e.X, testVar) {
-								continue
-							}
+			// Check the test does not read the results of the subtests after the loop, unless the group waits for them.
+			if !group && o.skipSubtestResults(scope, funcDecl, r, testVar) {
+				continue
+			}
 
-							if c, ok := e.X.(*ast.CallExpr); ok {
-								if len(c.Args) != 2 {
-									return true
-								}
-								funcArg := c.Args[1]
-								// insert parallel helper method
-								if fun, ok := funcArg.(*ast.FuncLit); ok {
-									innerTestVar := getRunCallbackParameterName(c)
-									tpStmt := buildTParallelStmt(fun.Body.Lbrace, innerTestVar)
-									fun.Body.List = append([]ast.Stmt{tpStmt}, fun.Body.List...)
-									isInsertedTparallel = true
-								}
-							}
-						}
-					}
-					// https://tip.golang.org/doc/go1.22
-					// Loop variables are not re-initialised if the minimum version of Go is less than 1.22
-					if needFixLoopVar && loopVariableUsedInRun != nil && !loopVarReInitialized {
-						// insert loop var reassignment statement
-						if v, ok := r.Value.(*ast.Ident); ok {
-							lv := buildLoopVarReAssignmentStmt(r.Body.Lbrace, v.Name)
-							r.Body.List = append([]ast.Stmt{lv}, r.Body.List...)
-						}
-					}
+			loopSubtests := o.parallelizeSubtests(scope, f, rv, funcDecl, r, testVar, needFixLoopVar, buildParallelStmt)
+			if len(loopSubtests) == 0 {
+				continue
+			}
+
+			parallelInserted = true
+
+			// The group waits for the subtests before the rest of the test runs.
+			if group {
+				if body, ok := scope.groupSubtests(f, rv, funcDecl, r, testVar); ok {
+					o.checkCaptures(scope, f, rv, funcDecl, body, testVar, loopSubtests)
+
+					continue
 				}
+			}
 
-				return true
-			})
+			subtests = append(subtests, loopSubtests...)
+		}
+
+		// Check the parallel subtests do not use the state the test releases or changes before they run.
+		o.checkCaptures(scope, f, rv, funcDecl, funcDecl.Body, testVar, subtests)
+
+		if len(subtests) > 0 {
+			parallelInserted = true
 		}
 
 		return true
 	})
 
+	// Parallelise the subtests registered by the helpers called only by parallel-safe tests.
+	for _, decl := range f.Decls {
+		helper, ok := decl.(*ast.FuncDecl)
+		if !ok || !isTparagenTargetFunc(helper.Doc) || !o.inLineRanges(fs, helper) {
+			continue
+		}
+
+		if _, isTest := o.testEntryPoint(f, helper); isTest {
+			continue
+		}
+
+		testVar, ok := scope.runHelperParam(helper)
+		if !ok {
+			continue
+		}
+
+		if !o.callersParallelSafe(scope, helper, testVar) {
+			o.explain(fs, helper.Pos(), helper.Name.Name, nil, "registers subtests, but is called by tests that are not parallel-safe, not processed")
+
+			continue
+		}
+
+		if o.helperSkipsSubtestResults(scope, helper, testVar) {
+			continue
+		}
+
+		subtests := o.parallelizeSubtests(scope, f, rv, helper, helper.Body, testVar, needFixLoopVar, buildParallelStmt)
+		o.checkCaptures(scope, f, rv, helper, helper.Body, testVar, subtests)
+
+		if len(subtests) > 0 {
+			parallelInserted = true
+		}
+	}
+
+	if needImport && parallelInserted {
+		call.addImport(fs, f, callPkgName)
+	}
+
 	// gofmt
 	var fmtedBuf bytes.Buffer
 	if err := format.Node(&fmtedBuf, fs, f); err != nil {
 		return nil, fmt.Errorf("gofmt error occurred. %w", err)
 	}
 
-	return fmtedBuf.Bytes(), nil
+	return rv.addOptOutDirectives(filename, fmtedBuf.Bytes())
+}
+
+// parsePackageFile returns the file name of packageFiles parsed into fs, or by parsedFiles.
+func (o *generateOptions) parsePackageFile(fs *token.FileSet, name string) (*ast.File, error) {
+	if o.parsedFiles != nil {
+		return o.parsedFiles.file(name)
+	}
+
+	return parser.ParseFile(fs, name, o.packageFiles[name], parser.ParseComments)
+}
+
+// GenerateOption configures GenerateTParallel.
+type GenerateOption func(*generateOptions)
+
+type generateOptions struct {
+	// lineRanges limits the rewrite to the functions overlapping them. nil means the whole file.
+	lineRanges []LineRange
+	// editFilter decides whether to insert each statement. nil accepts all.
+	editFilter func(Edit) Decision
+	// diagnostics receives the findings. nil discards them.
+	diagnostics func(Diagnostic) `fingerprint:"-"`
+	// insertDespiteHazards parallelises the tests using shared state anyway.
+	insertDespiteHazards bool
+	// insertIntoBDDSuites parallelises the tests bootstrapping BDD frameworks anyway.
+	insertIntoBDDSuites bool
+	// incompatibleFuncs are the fully-qualified names of the functions and methods
+	// that make the tests calling them unable to run in parallel.
+	incompatibleFuncs []string
+	// parallelHelpers are the fully-qualified names of the functions and methods
+	// that count as calling Parallel() on their *testing.T argument.
+	parallelHelpers []string
+	// detectParallelHelpers enables the detection of the parallel helpers of the imported packages.
+	detectParallelHelpers bool
+	// frameworks are the test frameworks whose entry points are parallelised besides go test.
+	frameworks []TestFramework
+	// packageFiles are the contents of the other files of the package keyed by their paths.
+	packageFiles map[string][]byte
+	// parsedFiles parses packageFiles, once for all the files of the package. nil means parsing them here.
+	parsedFiles *parsedFiles `fingerprint:"-"`
+	// parallelCall is the template of the call inserted instead of t.Parallel(). Empty means t.Parallel().
+	parallelCall string
+	// keepParentDefers leaves the defer statements releasing the state used by parallel subtests,
+	// instead of replacing them with t.Cleanup().
+	keepParentDefers bool
+	// groupSubtests wraps the loops registering parallel subtests in a group subtest when the test
+	// has statements running after them.
+	groupSubtests bool
+	// insertDespiteSubtestResults parallelises the subtests whose results the test reads after the loop anyway.
+	insertDespiteSubtestResults bool
+	// explanations receives the decisions about the tests and subtests. nil discards them.
+	explanations func(Explanation) `fingerprint:"-"`
+}
+
+func newGenerateOptions(opts ...GenerateOption) *generateOptions {
+	var o generateOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return &o
+}
+
+// WithParallelIncompatibleFuncs makes GenerateTParallel treat calls of the given functions
+// and methods like t.Setenv(): the test or subtest calling them is not parallelised.
+// The names are fully-qualified, such as "github.com/acme/testutil.SetGlobalClock" for
+// a function and "github.com/acme/dbtest.DB.Reset" or "(*github.com/acme/dbtest.DB).Reset"
+// for a method. Methods are resolved by type-checking the file.
+func WithParallelIncompatibleFuncs(names ...string) GenerateOption {
+	return func(o *generateOptions) {
+		o.incompatibleFuncs = append(o.incompatibleFuncs, names...)
+	}
+}
+
+// WithParallelHelpers makes GenerateTParallel treat calls of the given functions and methods
+// with the *testing.T of a test as calling Parallel() on it, so that no Parallel() is inserted.
+// The names are fully-qualified, as in WithParallelIncompatibleFuncs.
+// The functions of the package itself that unconditionally call Parallel() on their
+// *testing.T parameter are always treated so.
+func WithParallelHelpers(names ...string) GenerateOption {
+	return func(o *generateOptions) {
+		o.parallelHelpers = append(o.parallelHelpers, names...)
+	}
+}
+
+// WithParallelHelperDetection makes GenerateTParallel detect the functions of the imported
+// packages that unconditionally call Parallel() on their *testing.T parameter, and treat
+// them as in WithParallelHelpers. The file is type-checked for this.
+func WithParallelHelperDetection() GenerateOption {
+	return func(o *generateOptions) {
+		o.detectParallelHelpers = true
+	}
+}
+
+// WithParallelCall makes GenerateTParallel insert a call of a package-level function instead
+// of t.Parallel(), such as "github.com/acme/testenv.Parallel($t)", where $t stands for the
+// *testing.T variable and the other arguments are identifiers or literals. The package is
+// imported if needed, under an alias if its name is taken in the file. The function counts
+// as a parallel helper.
+func WithParallelCall(template string) GenerateOption {
+	return func(o *generateOptions) {
+		o.parallelCall = template
+	}
+}
+
+// WithLineRanges limits the rewrite to the functions overlapping any of the given line ranges.
+func WithLineRanges(ranges ...LineRange) GenerateOption {
+	return func(o *generateOptions) {
+		o.lineRanges = append([]LineRange{}, ranges...)
+	}
+}
+
+func (o *generateOptions) inLineRanges(fs *token.FileSet, funcDecl *ast.FuncDecl) bool {
+	if o.lineRanges == nil {
+		return true
+	}
+
+	start, end := fs.Position(funcDecl.Pos()).Line, fs.Position(funcDecl.End()).Line
+	for _, r := range o.lineRanges {
+		if r.overlaps(start, end) {
+			return true
+		}
+	}
+
+	return false
 }
 
 // Checks if the function has the param type *testing.T; if it does, then the
@@ -263,6 +539,9 @@ func isTestFunction(funcDecl *ast.FuncDecl) (bool, string) {
 	}
 
 	param := funcDecl.Type.Params.List[0]
+	if len(param.Names) != 1 {
+		return false, ""
+	}
 
 	starExp, ok := param.Type.(*ast.StarExpr)
 	if !ok {
@@ -286,12 +565,16 @@ func isTestFunction(funcDecl *ast.FuncDecl) (bool, string) {
 	return s.Name == testMethodPackageType, param.Names[0].Name
 }
 
-func exprCallHasMethod(node ast.Node, receiverName, methodName string) bool {
+// exprCallHasMethod reports whether node calls methodName on receiver, an expression
+// in Go syntax such as t or s.T().
+func exprCallHasMethod(node ast.Node, receiver, methodName string) bool {
 	if n, ok := node.(*ast.CallExpr); ok {
-		if fun, ok := n.Fun.(*ast.SelectorExpr); ok {
-			if receiver, ok := fun.X.(*ast.Ident); ok {
-				return receiver.Name == receiverName && fun.Sel.Name == methodName
+		if fun, ok := n.Fun.(*ast.SelectorExpr); ok && fun.Sel.Name == methodName {
+			if id, ok := fun.X.(*ast.Ident); ok {
+				return id.Name == receiver
 			}
+
+			return types.ExprString(fun.X) == receiver
 		}
 	}
 
@@ -342,7 +625,30 @@ func getRunCallbackParameterName(node ast.Node) string {
 	return ""
 }
 
-func methodParallelIsCalledInMethodRun(node ast.Node, testVar string) bool {
+// rangeSubtests reports whether r registers subtests by calling Run on testVar,
+// and whether it does so and none of them calls Parallel() or Setenv().
+func rangeSubtests(scope *pkgScope, r *ast.RangeStmt, testVar string) (registers, serial bool) {
+	var hasRun, hasParallel, hasSetenv bool
+
+	ast.Inspect(r, func(n ast.Node) bool {
+		if !hasRunMethod(n, testVar) {
+			return true
+		}
+
+		// n is a call to Run(); find out the name of the subtest's *testing.T parameter.
+		innerTestVar := getRunCallbackParameterName(n)
+
+		hasRun = true
+		hasParallel = hasParallel || methodParallelIsCalledInMethodRun(n, innerTestVar, scope)
+		hasSetenv = hasSetenv || methodSetEnvIsCalledInMethodRun(n, innerTestVar, scope)
+
+		return true
+	})
+
+	return hasRun, hasRun && !hasParallel && !hasSetenv
+}
+
+func methodParallelIsCalledInMethodRun(node ast.Node, testVar string, scope *pkgScope) bool {
 	var isCalledParallel bool
 
 	if callExp, ok := node.(*ast.CallExpr); ok {
@@ -350,7 +656,7 @@ func methodParallelIsCalledInMethodRun(node ast.Node, testVar string) bool {
 			if !isCalledParallel {
 				ast.Inspect(arg, func(n ast.Node) bool {
 					if !isCalledParallel {
-						isCalledParallel = hasParallelMethod(n, testVar)
+						isCalledParallel = scope.hasParallelCall(n, testVar)
 
 						return true
 					}
@@ -364,7 +670,7 @@ func methodParallelIsCalledInMethodRun(node ast.Node, testVar string) bool {
 	return isCalledParallel
 }
 
-func methodSetEnvIsCalledInMethodRun(node ast.Node, testVar string) bool {
+func methodSetEnvIsCalledInMethodRun(node ast.Node, testVar string, scope *pkgScope) bool {
 	var methodSetenvCalled bool
 
 	if callExp, ok := node.(*ast.CallExpr); ok {
@@ -372,7 +678,7 @@ func methodSetEnvIsCalledInMethodRun(node ast.Node, testVar string) bool {
 			if !methodSetenvCalled {
 				ast.Inspect(arg, func(n ast.Node) bool {
 					if !methodSetenvCalled {
-						methodSetenvCalled = hasSetenvMethod(n, testVar)
+						methodSetenvCalled = scope.hasSetenvCall(n, testVar)
 
 						return true
 					}
@@ -391,10 +697,7 @@ func buildTParallelStmt(pos token.Pos, testVar string) *ast.ExprStmt {
 	return &ast.ExprStmt{
 		X: &ast.CallExpr{
 			Fun: &ast.SelectorExpr{
-				X: &ast.Ident{
-					NamePos: pos,
-					Name:    testVar,
-				},
+				X: buildTestExpr(pos, testVar),
 				Sel: &ast.Ident{
 					NamePos: pos,
 					Name:    "Parallel",
@@ -425,43 +728,6 @@ func buildLoopVarReAssignmentStmt(pos token.Pos, varName string) *ast.AssignStmt
 	}
 }
 
-func loopVarReferencedInRun(call *ast.CallExpr, vars []types.Object, typeInfo *types.Info) (found *string) {
-	if len(call.Args) != 2 {
-		return nil
-	}
-
-	ast.Inspect(call.Args[1], func(n ast.Node) bool {
-		ident, ok := n.(*ast.Ident)
-		if !ok {
-			return true
-		}
-		for _, o := range vars {
-			if typeInfo.ObjectOf(ident) == o {
-				found = &ident.Name
-			}
-		}
-
-		return true
-	})
-
-	return found
-}
-
-func loopVarReAssigned(assign *ast.AssignStmt, vars []types.Object, typeInfo *types.Info) bool {
-	if len(assign.Rhs) != 1 || len(vars) != 2 {
-		return false
-	}
-
-	// e.g. tt := tt
-	if id, ok := assign.Rhs[0].(*ast.Ident); ok {
-		if typeInfo.ObjectOf(id) == vars[1] {
-			return true
-		}
-	}
-
-	return false
-}
-
 func hasNolintCommentDirective(cg *ast.CommentGroup) bool {
 	for _, c := range cg.List {
 		if c.Text == "//nolint" || strings.Contains(c.Text, "paralleltest") || strings.Contains(c.Text, "tparallel") {
@@ -469,7 +735,7 @@ func hasNolintCommentDirective(cg *ast.CommentGroup) bool {
 		}
 	}
 
-	return true
+	return false
 }
 
 // check file top comment
@@ -487,6 +753,28 @@ func isTparagenTargetFile(fileComments []*ast.CommentGroup) bool {
 	return true
 }
 
+// subtestOptedOut reports whether the statement registering a subtest with run, a call with a name
+// and a callback, has a nolint comment on the line above it, such as
+//
+//	//nolint:paralleltest
+//	t.Run("serial", func(t *testing.T) {
+func (s *pkgScope) subtestOptedOut(run *ast.CallExpr) bool {
+	f := s.fileOf(run.Pos()).ast
+	if f == nil || len(run.Args) != 2 {
+		return false
+	}
+
+	line := s.fs.Position(run.Pos()).Line
+
+	for _, cg := range f.Comments {
+		if s.fs.Position(cg.End()).Line == line-1 && hasNolintCommentDirective(cg) {
+			return true
+		}
+	}
+
+	return false
+}
+
 // if a function has a nolint comment, the function is removed from the target.
 // also, if a specific linter (tparallel, paralleltest) is specified with a nolint comment, it is removed from the target.
 func isTparagenTargetFunc(funcComment *ast.CommentGroup) bool {
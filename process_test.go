@@ -1,6 +1,8 @@
 package tparagen
 
 import (
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 )
@@ -12,6 +14,7 @@ func TestProcess(t *testing.T) {
 		testCase       string
 		src            string
 		needFixLoopVar bool
+		opts           []GenerateOption
 		want           string
 	}{
 		{
@@ -873,6 +876,85 @@ import "testing"
 func TestFunctionMissingParallelInMain(t *testing.T) {
 	t.Run("hoge", nil)
 }
+`,
+		},
+		{
+			testCase:       "insert Parallel into a test with a doc comment without nolint directive",
+			needFixLoopVar: true,
+			src: `package t
+
+import "testing"
+
+// TestFunctionWithDocComment is documented.
+func TestFunctionWithDocComment(t *testing.T) {
+	t.Run("hoge", nil)
+}`,
+			want: `package t
+
+import "testing"
+
+// TestFunctionWithDocComment is documented.
+func TestFunctionWithDocComment(t *testing.T) {
+	t.Parallel()
+	t.Run("hoge", nil)
+}
+`,
+		},
+		{
+			testCase:       "ignore paralleltest lint to sub test",
+			needFixLoopVar: true,
+			src: `package t
+
+import "testing"
+
+func TestFunctionMissingParallelInMain(t *testing.T) {
+	//nolint:paralleltest
+	t.Run("serial", func(t *testing.T) {
+		t.Log("serial")
+	})
+	t.Run("parallel", func(t *testing.T) {
+		t.Log("parallel")
+	})
+}`,
+			want: `package t
+
+import "testing"
+
+func TestFunctionMissingParallelInMain(t *testing.T) {
+	t.Parallel()
+	//nolint:paralleltest
+	t.Run("serial", func(t *testing.T) {
+		t.Log("serial")
+	})
+	t.Run("parallel", func(t *testing.T) {
+		t.Parallel()
+		t.Log("parallel")
+	})
+}
+`,
+		},
+		{
+			testCase:       "insert Parallel into a file beginning with a license header",
+			needFixLoopVar: true,
+			src: `// Copyright 2024 The Authors. All rights reserved.
+
+package t
+
+import "testing"
+
+func TestFunctionMissingParallelInMain(t *testing.T) {
+	t.Run("hoge", nil)
+}`,
+			want: `// Copyright 2024 The Authors. All rights reserved.
+
+package t
+
+import "testing"
+
+func TestFunctionMissingParallelInMain(t *testing.T) {
+	t.Parallel()
+	t.Run("hoge", nil)
+}
 `,
 		},
 		{
@@ -994,19 +1076,2847 @@ func TestFunctionRangeMissingCallToParallel(t *testing.T) {
 }
 `,
 		},
+		{
+			testCase:       "only functions within the line ranges",
+			needFixLoopVar: false,
+			opts:           []GenerateOption{WithLineRanges(LineRange{Start: 10, End: 10})},
+			src: `package t
+
+import "testing"
+
+func TestUnchanged(t *testing.T) {
+	t.Run("hoge", nil)
+}
+
+func TestChanged(t *testing.T) {
+	t.Run("hoge", nil)
+}
+`,
+			want: `package t
+
+import "testing"
+
+func TestUnchanged(t *testing.T) {
+	t.Run("hoge", nil)
+}
+
+func TestChanged(t *testing.T) {
+	t.Parallel()
+	t.Run("hoge", nil)
+}
+`,
+		},
+		{
+			testCase:       "insert only the accepted edits",
+			needFixLoopVar: false,
+			opts: []GenerateOption{WithEditFilter(func(e Edit) Decision {
+				if e.Subtest == "" {
+					return Skip
+				}
+
+				return Accept
+			})},
+			src: `package t
+
+import "testing"
+
+func TestFunctionMissingParallelAllTests(t *testing.T) {
+	t.Run("1", func(t *testing.T) {
+		fmt.Println("1")
+	})
+}
+`,
+			want: `package t
+
+import "testing"
+
+func TestFunctionMissingParallelAllTests(t *testing.T) {
+	t.Run("1", func(t *testing.T) {
+		t.Parallel()
+		fmt.Println("1")
+	})
+}
+`,
+		},
+		{
+			testCase:       "add the opt-out directive to the opted out test",
+			needFixLoopVar: false,
+			opts: []GenerateOption{WithEditFilter(func(e Edit) Decision {
+				if e.Func == "TestOptOut" {
+					return OptOut
+				}
+
+				return Accept
+			})},
+			src: `package t
+
+import "testing"
+
+func TestOptOut(t *testing.T) {
+	t.Run("1", func(t *testing.T) {
+		fmt.Println("1")
+	})
+}
+
+func TestAccept(t *testing.T) {
+	t.Run("hoge", nil)
+}
+`,
+			want: `package t
+
+import "testing"
+
+//nolint:paralleltest
+func TestOptOut(t *testing.T) {
+	t.Run("1", func(t *testing.T) {
+		fmt.Println("1")
+	})
+}
+
+func TestAccept(t *testing.T) {
+	t.Parallel()
+	t.Run("hoge", nil)
+}
+`,
+		},
+		{
+			testCase:       "drop the edits accepted before opting out the test",
+			needFixLoopVar: true,
+			opts: []GenerateOption{WithParallelCall("github.com/acme/testenv.Parallel($t)"), WithEditFilter(func(e Edit) Decision {
+				if e.Subtest != "" {
+					return OptOut
+				}
+
+				return Accept
+			})},
+			src: `package t
+
+import "testing"
+
+func TestOptOut(t *testing.T) {
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			fmt.Println(tc.name)
+		})
 	}
+}
+`,
+			want: `package t
 
-	for _, tt := range tests {
-		t.Run(tt.testCase, func(t *testing.T) {
-			t.Parallel()
+import "testing"
 
-			got, err := GenerateTParallel("./testdata/t/t_test.go", []byte(tt.src), tt.needFixLoopVar)
-			if err != nil {
-				t.Fatal(err.Error())
-			}
-			if !reflect.DeepEqual(got, []byte(tt.want)) {
-				t.Errorf("result:\n%v, want:\n%v", string(got), tt.want)
-			}
+//nolint:paralleltest
+func TestOptOut(t *testing.T) {
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			fmt.Println(tc.name)
 		})
 	}
 }
+`,
+		},
+		{
+			testCase:       "skip a test writing a package-level variable",
+			needFixLoopVar: false,
+			src: `package t
+
+import "testing"
+
+var counter int
+
+func TestWritesPackageVar(t *testing.T) {
+	counter++
+	t.Run("1", func(t *testing.T) {
+		fmt.Println(counter)
+	})
+}
+`,
+			want: `package t
+
+import "testing"
+
+var counter int
+
+func TestWritesPackageVar(t *testing.T) {
+	counter++
+	t.Run("1", func(t *testing.T) {
+		fmt.Println(counter)
+	})
+}
+`,
+		},
+		{
+			testCase:       "skip a test changing process-wide state in a subtest through a helper",
+			needFixLoopVar: false,
+			src: `package t
+
+import (
+	stdos "os"
+	"testing"
+)
+
+func moveTo(dir string) {
+	stdos.Chdir(dir)
+}
+
+func TestChdirInHelper(t *testing.T) {
+	t.Run("1", func(t *testing.T) {
+		moveTo("/")
+	})
+}
+`,
+			want: `package t
+
+import (
+	stdos "os"
+	"testing"
+)
+
+func moveTo(dir string) {
+	stdos.Chdir(dir)
+}
+
+func TestChdirInHelper(t *testing.T) {
+	t.Run("1", func(t *testing.T) {
+		moveTo("/")
+	})
+}
+`,
+		},
+		{
+			testCase:       "insert into a test writing a local variable shadowing a package-level one",
+			needFixLoopVar: false,
+			src: `package t
+
+import "testing"
+
+var counter int
+
+func TestWritesLocalVar(t *testing.T) {
+	counter := 0
+	counter++
+	flag := struct{ Set func() }{}
+	flag.Set()
+}
+`,
+			want: `package t
+
+import "testing"
+
+var counter int
+
+func TestWritesLocalVar(t *testing.T) {
+	t.Parallel()
+	counter := 0
+	counter++
+	flag := struct{ Set func() }{}
+	flag.Set()
+}
+`,
+		},
+		{
+			testCase:       "insert into a test using shared state when only warned",
+			needFixLoopVar: false,
+			opts:           []GenerateOption{WithInsertDespiteHazards()},
+			src: `package t
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestSwapsGlobal(t *testing.T) {
+	http.DefaultClient = nil
+}
+`,
+			want: `package t
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestSwapsGlobal(t *testing.T) {
+	t.Parallel()
+	http.DefaultClient = nil
+}
+`,
+		},
+		{
+			testCase:       "main test function calls os.Setenv",
+			needFixLoopVar: false,
+			src: `package t
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMainCallsOsSetenv(t *testing.T) {
+	os.Setenv("TEST", "test")
+	defer os.Unsetenv("TEST")
+	t.Run("1", func(t *testing.T) {
+		fmt.Println("1")
+	})
+}
+`,
+			want: `package t
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMainCallsOsSetenv(t *testing.T) {
+	os.Setenv("TEST", "test")
+	defer os.Unsetenv("TEST")
+	t.Run("1", func(t *testing.T) {
+		fmt.Println("1")
+	})
+}
+`,
+		},
+		{
+			testCase:       "main test function calls os.Setenv in an if statement",
+			needFixLoopVar: false,
+			src: `package t
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMainCallsOsSetenvInIf(t *testing.T) {
+	if err := os.Setenv("TEST", "test"); err != nil {
+		t.Fatal(err)
+	}
+}
+`,
+			want: `package t
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMainCallsOsSetenvInIf(t *testing.T) {
+	if err := os.Setenv("TEST", "test"); err != nil {
+		t.Fatal(err)
+	}
+}
+`,
+		},
+		{
+			testCase:       "main test function calls os.Chdir in an assignment",
+			needFixLoopVar: false,
+			src: `package t
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMainCallsOsChdirInAssignment(t *testing.T) {
+	err := os.Chdir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+`,
+			want: `package t
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMainCallsOsChdirInAssignment(t *testing.T) {
+	err := os.Chdir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+`,
+		},
+		{
+			testCase:       "main test function defers os.Unsetenv",
+			needFixLoopVar: false,
+			src: `package t
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMainDefersOsUnsetenv(t *testing.T) {
+	defer os.Unsetenv("TEST")
+	t.Log(os.Getenv("TEST"))
+}
+`,
+			want: `package t
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMainDefersOsUnsetenv(t *testing.T) {
+	defer os.Unsetenv("TEST")
+	t.Log(os.Getenv("TEST"))
+}
+`,
+		},
+		{
+			testCase:       "main test function calls t.Setenv in an if statement",
+			needFixLoopVar: false,
+			src: `package t
+
+import "testing"
+
+func TestMainCallsSetenvInIf(t *testing.T) {
+	if testing.Short() {
+		t.Setenv("TEST", "test")
+	}
+	t.Run("1", func(t *testing.T) {
+		t.Log("1")
+	})
+}
+`,
+			want: `package t
+
+import "testing"
+
+func TestMainCallsSetenvInIf(t *testing.T) {
+	if testing.Short() {
+		t.Setenv("TEST", "test")
+	}
+	t.Run("1", func(t *testing.T) {
+		t.Parallel()
+		t.Log("1")
+	})
+}
+`,
+		},
+		{
+			testCase:       "sub test functions call os.Chdir with an import name",
+			needFixLoopVar: false,
+			src: `package t
+
+import (
+	goos "os"
+	"testing"
+)
+
+func TestSubCallsOsChdir(t *testing.T) {
+	t.Run("1", func(t *testing.T) {
+		goos.Chdir("/")
+	})
+
+	testCases := []struct {
+		name string
+	}{{name: "foo"}}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			goos.Unsetenv(tc.name)
+		})
+	}
+}
+`,
+			want: `package t
+
+import (
+	goos "os"
+	"testing"
+)
+
+func TestSubCallsOsChdir(t *testing.T) {
+	t.Parallel()
+	t.Run("1", func(t *testing.T) {
+		goos.Chdir("/")
+	})
+
+	testCases := []struct {
+		name string
+	}{{name: "foo"}}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			goos.Unsetenv(tc.name)
+		})
+	}
+}
+`,
+		},
+		{
+			testCase:       "Setenv of a local variable named os is not os.Setenv",
+			needFixLoopVar: false,
+			src: `package t
+
+import "testing"
+
+func TestLocalOsSetenv(t *testing.T) {
+	os := fakeEnv{}
+	os.Setenv("TEST", "test")
+}
+`,
+			want: `package t
+
+import "testing"
+
+func TestLocalOsSetenv(t *testing.T) {
+	t.Parallel()
+	os := fakeEnv{}
+	os.Setenv("TEST", "test")
+}
+`,
+		},
+		{
+			testCase:       "user-defined parallel incompatible function and method",
+			needFixLoopVar: false,
+			opts: []GenerateOption{WithParallelIncompatibleFuncs(
+				"github.com/acme/testutil.SetGlobalClock",
+				"(*bytes.Buffer).Reset",
+			)},
+			src: `package t
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/acme/testutil"
+)
+
+func TestUserDefinedIncompatible(t *testing.T) {
+	testutil.SetGlobalClock(t, nil)
+	t.Run("1", func(t *testing.T) {
+		var buf bytes.Buffer
+		buf.Reset()
+	})
+	t.Run("2", func(t *testing.T) {
+		var buf bytes.Buffer
+		buf.Len()
+	})
+}
+`,
+			want: `package t
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/acme/testutil"
+)
+
+func TestUserDefinedIncompatible(t *testing.T) {
+	testutil.SetGlobalClock(t, nil)
+	t.Run("1", func(t *testing.T) {
+		var buf bytes.Buffer
+		buf.Reset()
+	})
+	t.Run("2", func(t *testing.T) {
+		t.Parallel()
+		var buf bytes.Buffer
+		buf.Len()
+	})
+}
+`,
+		},
+		{
+			testCase:       "user-defined parallel incompatible function in an assignment and a defer statement",
+			needFixLoopVar: false,
+			opts:           []GenerateOption{WithParallelIncompatibleFuncs("github.com/acme/testutil.SetGlobalClock")},
+			src: `package t
+
+import (
+	"testing"
+
+	"github.com/acme/testutil"
+)
+
+func TestIncompatibleInAssignment(t *testing.T) {
+	restore := testutil.SetGlobalClock(t, nil)
+	defer restore()
+}
+
+func TestIncompatibleInDefer(t *testing.T) {
+	defer testutil.SetGlobalClock(t, nil)()
+}
+
+func TestSubtestsIncompatible(t *testing.T) {
+	t.Run("assignment", func(t *testing.T) {
+		restore := testutil.SetGlobalClock(t, nil)
+		defer restore()
+	})
+	t.Run("defer", func(t *testing.T) {
+		defer testutil.SetGlobalClock(t, nil)()
+	})
+}
+`,
+			want: `package t
+
+import (
+	"testing"
+
+	"github.com/acme/testutil"
+)
+
+func TestIncompatibleInAssignment(t *testing.T) {
+	restore := testutil.SetGlobalClock(t, nil)
+	defer restore()
+}
+
+func TestIncompatibleInDefer(t *testing.T) {
+	defer testutil.SetGlobalClock(t, nil)()
+}
+
+func TestSubtestsIncompatible(t *testing.T) {
+	t.Parallel()
+	t.Run("assignment", func(t *testing.T) {
+		restore := testutil.SetGlobalClock(t, nil)
+		defer restore()
+	})
+	t.Run("defer", func(t *testing.T) {
+		defer testutil.SetGlobalClock(t, nil)()
+	})
+}
+`,
+		},
+		{
+			testCase:       "user-defined parallel helper",
+			needFixLoopVar: false,
+			opts:           []GenerateOption{WithParallelHelpers("github.com/acme/testutil.Parallel")},
+			src: `package t
+
+import (
+	"testing"
+
+	"github.com/acme/testutil"
+)
+
+func TestUserDefinedParallelHelper(t *testing.T) {
+	testutil.Parallel(t)
+	t.Run("1", func(t *testing.T) {
+		fmt.Println("1")
+	})
+}
+`,
+			want: `package t
+
+import (
+	"testing"
+
+	"github.com/acme/testutil"
+)
+
+func TestUserDefinedParallelHelper(t *testing.T) {
+	testutil.Parallel(t)
+	t.Run("1", func(t *testing.T) {
+		t.Parallel()
+		fmt.Println("1")
+	})
+}
+`,
+		},
+		{
+			testCase:       "parallel helper of the package",
+			needFixLoopVar: false,
+			src: `package t
+
+import "testing"
+
+func parallel(tb testing.TB) {
+	tb.Helper()
+	tb.Parallel()
+}
+
+func maybeParallel(t *testing.T) {
+	if os.Getenv("PARALLEL") != "" {
+		t.Parallel()
+	}
+}
+
+func TestParallelHelper(t *testing.T) {
+	parallel(t)
+	t.Run("1", func(t *testing.T) {
+		maybeParallel(t)
+	})
+}
+`,
+			want: `package t
+
+import "testing"
+
+func parallel(tb testing.TB) {
+	tb.Helper()
+	tb.Parallel()
+}
+
+func maybeParallel(t *testing.T) {
+	if os.Getenv("PARALLEL") != "" {
+		t.Parallel()
+	}
+}
+
+func TestParallelHelper(t *testing.T) {
+	parallel(t)
+	t.Run("1", func(t *testing.T) {
+		t.Parallel()
+		maybeParallel(t)
+	})
+}
+`,
+		},
+		{
+			testCase:       "configured parallel call",
+			needFixLoopVar: false,
+			opts:           []GenerateOption{WithParallelCall("github.com/acme/testenv.Parallel($t)")},
+			src: `package t
+
+import "testing"
+
+func TestConfiguredParallelCall(t *testing.T) {
+	t.Run("1", func(t *testing.T) {
+		fmt.Println("1")
+	})
+}
+`,
+			want: `package t
+
+import (
+	"github.com/acme/testenv"
+	"testing"
+)
+
+func TestConfiguredParallelCall(t *testing.T) {
+	testenv.Parallel(t)
+	t.Run("1", func(t *testing.T) {
+		testenv.Parallel(t)
+		fmt.Println("1")
+	})
+}
+`,
+		},
+		{
+			testCase:       "configured parallel call already imported and called",
+			needFixLoopVar: false,
+			opts:           []GenerateOption{WithParallelCall("github.com/acme/testenv/v2.Parallel(ctx, $t)")},
+			src: `package t
+
+import (
+	"testing"
+
+	env "github.com/acme/testenv/v2"
+)
+
+func TestConfiguredParallelCallImported(t *testing.T) {
+	env.Parallel(ctx, t)
+	t.Run("1", func(t *testing.T) {
+		fmt.Println("1")
+	})
+}
+`,
+			want: `package t
+
+import (
+	"testing"
+
+	env "github.com/acme/testenv/v2"
+)
+
+func TestConfiguredParallelCallImported(t *testing.T) {
+	env.Parallel(ctx, t)
+	t.Run("1", func(t *testing.T) {
+		env.Parallel(ctx, t)
+		fmt.Println("1")
+	})
+}
+`,
+		},
+		{
+			testCase:       "configured parallel call with name collision",
+			needFixLoopVar: false,
+			opts:           []GenerateOption{WithParallelCall("github.com/acme/testenv.Parallel($t)")},
+			src: `package t
+
+import "testing"
+
+var testenv = "local"
+
+func TestConfiguredParallelCallCollision(t *testing.T) {
+	fmt.Println(testenv)
+}
+`,
+			want: `package t
+
+import (
+	testenv2 "github.com/acme/testenv"
+	"testing"
+)
+
+var testenv = "local"
+
+func TestConfiguredParallelCallCollision(t *testing.T) {
+	testenv2.Parallel(t)
+	fmt.Println(testenv)
+}
+`,
+		},
+		{
+			testCase:       "configured parallel call imported under an alias when its name is declared in another file of the package",
+			needFixLoopVar: false,
+			opts: []GenerateOption{
+				WithParallelCall("github.com/acme/testenv.Parallel($t)"),
+				WithPackageFiles(map[string][]byte{
+					"./testdata/t/env_test.go": []byte(`package t
+
+type testenv struct{}
+`),
+				}),
+			},
+			src: `package t
+
+import "testing"
+
+func TestConfiguredParallelCallNameTakenInPackage(t *testing.T) {
+	_ = testenv{}
+}
+`,
+			want: `package t
+
+import (
+	testenv2 "github.com/acme/testenv"
+	"testing"
+)
+
+func TestConfiguredParallelCallNameTakenInPackage(t *testing.T) {
+	testenv2.Parallel(t)
+	_ = testenv{}
+}
+`,
+		},
+		{
+			testCase:       "configured parallel call not imported when nothing inserted",
+			needFixLoopVar: false,
+			opts:           []GenerateOption{WithParallelCall("github.com/acme/testenv.Parallel($t)")},
+			src: `package t
+
+import "testing"
+
+func TestConfiguredParallelCallNotInserted(t *testing.T) {
+	t.Parallel()
+}
+`,
+			want: `package t
+
+import "testing"
+
+func TestConfiguredParallelCallNotInserted(t *testing.T) {
+	t.Parallel()
+}
+`,
+		},
+		{
+			testCase:       "testify suite",
+			needFixLoopVar: false,
+			opts:           []GenerateOption{WithTestFrameworks(TestifySuite())},
+			src: `package t
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type MySuite struct {
+	suite.Suite
+}
+
+func (s *MySuite) TestFoo() {
+	s.T().Run("1", func(t *testing.T) {
+		fmt.Println("1")
+	})
+}
+
+func (s *MySuite) TestParallel() {
+	s.T().Parallel()
+}
+
+func (s *MySuite) helper() {}
+
+func TestMySuite(t *testing.T) {
+	suite.Run(t, new(MySuite))
+}
+`,
+			want: `package t
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type MySuite struct {
+	suite.Suite
+}
+
+func (s *MySuite) TestFoo() {
+	s.T().Parallel()
+	s.T().Run("1", func(t *testing.T) {
+		t.Parallel()
+		fmt.Println("1")
+	})
+}
+
+func (s *MySuite) TestParallel() {
+	s.T().Parallel()
+}
+
+func (s *MySuite) helper() {}
+
+func TestMySuite(t *testing.T) {
+	t.Parallel()
+	suite.Run(t, new(MySuite))
+}
+`,
+		},
+		{
+			testCase:       "testify enabled for a type not embedding suite.Suite",
+			needFixLoopVar: false,
+			opts:           []GenerateOption{WithTestFrameworks(TestifySuite())},
+			src: `package t
+
+import "github.com/stretchr/testify/suite"
+
+type MySuite struct {
+	s suite.Suite
+}
+
+type Other struct{}
+
+func (s *MySuite) TestFoo() {
+	fmt.Println("1")
+}
+
+func (o *Other) TestBar() {
+	fmt.Println("1")
+}
+`,
+			want: `package t
+
+import "github.com/stretchr/testify/suite"
+
+type MySuite struct {
+	s suite.Suite
+}
+
+type Other struct{}
+
+func (s *MySuite) TestFoo() {
+	fmt.Println("1")
+}
+
+func (o *Other) TestBar() {
+	fmt.Println("1")
+}
+`,
+		},
+		{
+			testCase:       "testify suite not enabled",
+			needFixLoopVar: false,
+			src: `package t
+
+func (s *MySuite) TestFoo() {
+	fmt.Println("1")
+}
+`,
+			want: `package t
+
+func (s *MySuite) TestFoo() {
+	fmt.Println("1")
+}
+`,
+		},
+		{
+			testCase:       "custom suite type",
+			needFixLoopVar: false,
+			opts:           []GenerateOption{WithTestFrameworks(SuiteType("wrapper"), SuiteType("runner"))},
+			src: `package t
+
+import "testing"
+
+type wrapper struct {
+	*testing.T
+}
+
+func (w *wrapper) TestEmbedded() {
+	w.Setenv("KEY", "value")
+}
+
+func (w wrapper) TestEmbeddedParallel() {
+	fmt.Println("1")
+}
+
+func (r *runner) TestParam(t *testing.T) {
+	fmt.Println("1")
+}
+
+func (o *other) TestOther() {
+	fmt.Println("1")
+}
+`,
+			want: `package t
+
+import "testing"
+
+type wrapper struct {
+	*testing.T
+}
+
+func (w *wrapper) TestEmbedded() {
+	w.Setenv("KEY", "value")
+}
+
+func (w wrapper) TestEmbeddedParallel() {
+	w.Parallel()
+	fmt.Println("1")
+}
+
+func (r *runner) TestParam(t *testing.T) {
+	t.Parallel()
+	fmt.Println("1")
+}
+
+func (o *other) TestOther() {
+	fmt.Println("1")
+}
+`,
+		},
+		{
+			testCase:       "testify suite with parallel call",
+			needFixLoopVar: false,
+			opts: []GenerateOption{
+				WithTestFrameworks(TestifySuite()),
+				WithParallelCall("github.com/acme/testenv.Parallel($t)"),
+			},
+			src: `package t
+
+import (
+	"github.com/acme/testenv"
+	"github.com/stretchr/testify/suite"
+)
+
+type MySuite struct {
+	suite.Suite
+}
+
+func (s *MySuite) TestFoo() {
+	fmt.Println("1")
+}
+
+func (s *MySuite) TestBar() {
+	testenv.Parallel(s.T())
+}
+`,
+			want: `package t
+
+import (
+	"github.com/acme/testenv"
+	"github.com/stretchr/testify/suite"
+)
+
+type MySuite struct {
+	suite.Suite
+}
+
+func (s *MySuite) TestFoo() {
+	testenv.Parallel(s.T())
+	fmt.Println("1")
+}
+
+func (s *MySuite) TestBar() {
+	testenv.Parallel(s.T())
+}
+`,
+		},
+		{
+			testCase:       "ginkgo suite",
+			needFixLoopVar: false,
+			src: `package t
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestSuite(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Suite")
+}
+
+func TestOther(t *testing.T) {
+	fmt.Println("1")
+}
+`,
+			want: `package t
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestSuite(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Suite")
+}
+
+func TestOther(t *testing.T) {
+	t.Parallel()
+	fmt.Println("1")
+}
+`,
+		},
+		{
+			testCase:       "godog suite",
+			needFixLoopVar: false,
+			src: `package t
+
+import (
+	"testing"
+
+	"github.com/cucumber/godog"
+)
+
+func TestFeatures(t *testing.T) {
+	suite := godog.TestSuite{ScenarioInitializer: InitializeScenario}
+	if suite.Run() != 0 {
+		t.Fatal("failed")
+	}
+}
+`,
+			want: `package t
+
+import (
+	"testing"
+
+	"github.com/cucumber/godog"
+)
+
+func TestFeatures(t *testing.T) {
+	suite := godog.TestSuite{ScenarioInitializer: InitializeScenario}
+	if suite.Run() != 0 {
+		t.Fatal("failed")
+	}
+}
+`,
+		},
+		{
+			testCase:       "ginkgo suite parallelised anyway",
+			needFixLoopVar: false,
+			opts:           []GenerateOption{WithInsertIntoBDDSuites()},
+			src: `package t
+
+import (
+	"testing"
+
+	"github.com/onsi/ginkgo"
+)
+
+func TestSuite(t *testing.T) {
+	ginkgo.RunSpecs(t, "Suite")
+}
+`,
+			want: `package t
+
+import (
+	"testing"
+
+	"github.com/onsi/ginkgo"
+)
+
+func TestSuite(t *testing.T) {
+	t.Parallel()
+	ginkgo.RunSpecs(t, "Suite")
+}
+`,
+		},
+		{
+			testCase:       "local function named like a bootstrap",
+			needFixLoopVar: false,
+			src: `package t
+
+import "testing"
+
+func RunSpecs(t *testing.T, name string) {}
+
+func TestSuite(t *testing.T) {
+	RunSpecs(t, "Suite")
+}
+`,
+			want: `package t
+
+import "testing"
+
+func RunSpecs(t *testing.T, name string) {}
+
+func TestSuite(t *testing.T) {
+	t.Parallel()
+	RunSpecs(t, "Suite")
+}
+`,
+		},
+		{
+			testCase:       "parallel helper in another file of the package",
+			needFixLoopVar: false,
+			opts: []GenerateOption{WithPackageFiles(map[string][]byte{
+				"./testdata/t/helpers_test.go": []byte(`package t
+
+import tt "testing"
+
+func parallel(t *tt.T) {
+	t.Parallel()
+}
+`),
+			})},
+			src: `package t
+
+import "testing"
+
+func TestHelperInAnotherFile(t *testing.T) {
+	parallel(t)
+}
+`,
+			want: `package t
+
+import "testing"
+
+func TestHelperInAnotherFile(t *testing.T) {
+	parallel(t)
+}
+`,
+		},
+		{
+			testCase:       "blank identifier declared in another file of the package",
+			needFixLoopVar: false,
+			opts: []GenerateOption{WithPackageFiles(map[string][]byte{
+				"./testdata/t/t.go": []byte(`package t
+
+import "io"
+
+type reader struct{}
+
+func (*reader) Read([]byte) (int, error) { return 0, nil }
+
+var _ io.Reader = (*reader)(nil)
+`),
+			})},
+			src: `package t
+
+import "testing"
+
+func TestBlank(t *testing.T) {
+	v := 1
+	_ = v
+}
+`,
+			want: `package t
+
+import "testing"
+
+func TestBlank(t *testing.T) {
+	t.Parallel()
+	v := 1
+	_ = v
+}
+`,
+		},
+		{
+			testCase:       "package-level variable in another file of the package",
+			needFixLoopVar: false,
+			opts: []GenerateOption{WithPackageFiles(map[string][]byte{
+				"./testdata/t/t.go": []byte(`package t
+
+var counter int
+`),
+				"./testdata/t/external_test.go": []byte(`package t_test
+
+var total int
+`),
+			})},
+			src: `package t
+
+import "testing"
+
+func TestWritesCounter(t *testing.T) {
+	counter = 1
+}
+
+func TestWritesTotal(t *testing.T) {
+	total = 1
+}
+`,
+			want: `package t
+
+import "testing"
+
+func TestWritesCounter(t *testing.T) {
+	counter = 1
+}
+
+func TestWritesTotal(t *testing.T) {
+	t.Parallel()
+	total = 1
+}
+`,
+		},
+		{
+			testCase:       "subtests registered by a helper",
+			needFixLoopVar: true,
+			src: `package t
+
+import "testing"
+
+type testCase struct {
+	name string
+}
+
+func runCases(t *testing.T, cases []testCase) {
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			fmt.Println(tc.name)
+		})
+	}
+}
+
+func TestA(t *testing.T) {
+	runCases(t, []testCase{{name: "a"}})
+}
+
+func TestB(t *testing.T) {
+	t.Parallel()
+	t.Run("b", func(t *testing.T) {
+		runCases(t, nil)
+	})
+}
+`,
+			want: `package t
+
+import "testing"
+
+type testCase struct {
+	name string
+}
+
+func runCases(t *testing.T, cases []testCase) {
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			fmt.Println(tc.name)
+		})
+	}
+}
+
+func TestA(t *testing.T) {
+	t.Parallel()
+	runCases(t, []testCase{{name: "a"}})
+}
+
+func TestB(t *testing.T) {
+	t.Parallel()
+	t.Run("b", func(t *testing.T) {
+		t.Parallel()
+		runCases(t, nil)
+	})
+}
+`,
+		},
+		{
+			testCase:       "subtests registered by a helper called by a test using t.Setenv",
+			needFixLoopVar: false,
+			src: `package t
+
+import "testing"
+
+func runCases(t *testing.T) {
+	t.Run("1", func(t *testing.T) {
+		fmt.Println("1")
+	})
+}
+
+func TestA(t *testing.T) {
+	runCases(t)
+}
+
+func TestB(t *testing.T) {
+	t.Setenv("KEY", "value")
+	runCases(t)
+}
+`,
+			want: `package t
+
+import "testing"
+
+func runCases(t *testing.T) {
+	t.Run("1", func(t *testing.T) {
+		fmt.Println("1")
+	})
+}
+
+func TestA(t *testing.T) {
+	t.Parallel()
+	runCases(t)
+}
+
+func TestB(t *testing.T) {
+	t.Setenv("KEY", "value")
+	runCases(t)
+}
+`,
+		},
+		{
+			testCase:       "subtests registered by a helper used as a function value",
+			needFixLoopVar: false,
+			src: `package t
+
+import "testing"
+
+func runCases(t *testing.T) {
+	t.Run("1", func(t *testing.T) {
+		fmt.Println("1")
+	})
+}
+
+func TestA(t *testing.T) {
+	t.Parallel()
+	run := runCases
+	run(t)
+}
+`,
+			want: `package t
+
+import "testing"
+
+func runCases(t *testing.T) {
+	t.Run("1", func(t *testing.T) {
+		fmt.Println("1")
+	})
+}
+
+func TestA(t *testing.T) {
+	t.Parallel()
+	run := runCases
+	run(t)
+}
+`,
+		},
+		{
+			testCase:       "subtests registered by a helper called from another file",
+			needFixLoopVar: false,
+			opts: []GenerateOption{WithPackageFiles(map[string][]byte{
+				"./testdata/t/a_test.go": []byte(`package t
+
+import (
+	"os"
+	"testing"
+)
+
+func TestA(t *testing.T) {
+	os.Chdir("testdata")
+	runCases(t)
+}
+`),
+			})},
+			src: `package t
+
+import "testing"
+
+func runCases(t *testing.T) {
+	t.Run("1", func(t *testing.T) {
+		fmt.Println("1")
+	})
+}
+`,
+			want: `package t
+
+import "testing"
+
+func runCases(t *testing.T) {
+	t.Run("1", func(t *testing.T) {
+		fmt.Println("1")
+	})
+}
+`,
+		},
+		{
+			testCase:       "subtests registered by a helper using the state its caller releases with defer",
+			needFixLoopVar: false,
+			src: `package t
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func runCases(t *testing.T, srv *httptest.Server, cases []string) {
+	for _, tc := range cases {
+		t.Run(tc, func(t *testing.T) {
+			get(srv.URL + tc)
+		})
+	}
+}
+
+func TestA(t *testing.T) {
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+	runCases(t, srv, []string{"/a"})
+}
+`,
+			want: `package t
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func runCases(t *testing.T, srv *httptest.Server, cases []string) {
+	for _, tc := range cases {
+		t.Run(tc, func(t *testing.T) {
+			get(srv.URL + tc)
+		})
+	}
+}
+
+func TestA(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+	runCases(t, srv, []string{"/a"})
+}
+`,
+		},
+		{
+			testCase:       "subtests registered by a helper writing the state its caller reads afterwards",
+			needFixLoopVar: false,
+			src: `package t
+
+import "testing"
+
+func collect(t *testing.T, got *[]string) {
+	t.Run("a", func(t *testing.T) {
+		*got = append(*got, "a")
+	})
+}
+
+func TestA(t *testing.T) {
+	var got []string
+	collect(t, &got)
+	if len(got) != 1 {
+		t.Errorf("got %v", got)
+	}
+}
+`,
+			want: `package t
+
+import "testing"
+
+func collect(t *testing.T, got *[]string) {
+	t.Run("a", func(t *testing.T) {
+		*got = append(*got, "a")
+	})
+}
+
+func TestA(t *testing.T) {
+	t.Parallel()
+	var got []string
+	collect(t, &got)
+	if len(got) != 1 {
+		t.Errorf("got %v", got)
+	}
+}
+`,
+		},
+		{
+			testCase:       "ignore the subtests using the variables of a range loop assigning with =",
+			needFixLoopVar: false,
+			src: `package t
+
+import "testing"
+
+func TestAssign(t *testing.T) {
+	var tc testCase
+	for _, tc = range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			fmt.Println(tc.name)
+		})
+		t.Run("other", func(t *testing.T) {
+			fmt.Println(tc.name)
+		})
+	}
+}
+`,
+			want: `package t
+
+import "testing"
+
+func TestAssign(t *testing.T) {
+	t.Parallel()
+	var tc testCase
+	for _, tc = range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			fmt.Println(tc.name)
+		})
+		t.Run("other", func(t *testing.T) {
+			fmt.Println(tc.name)
+		})
+	}
+}
+`,
+		},
+		{
+			testCase:       "copy the key and the value of a map range captured by the subtest",
+			needFixLoopVar: true,
+			src: `package t
+
+import "testing"
+
+func TestMap(t *testing.T) {
+	cases := map[string]struct {
+		in string
+	}{"foo": {in: "foo"}}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			fmt.Println(name, tc.in)
+		})
+	}
+}
+`,
+			want: `package t
+
+import "testing"
+
+func TestMap(t *testing.T) {
+	t.Parallel()
+	cases := map[string]struct {
+		in string
+	}{"foo": {in: "foo"}}
+
+	for name, tc := range cases {
+		name := name
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			fmt.Println(name, tc.in)
+		})
+	}
+}
+`,
+		},
+		{
+			testCase:       "copy only the variables of a range captured by the subtest",
+			needFixLoopVar: true,
+			src: `package t
+
+import "testing"
+
+func TestMap(t *testing.T) {
+	for name, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			fmt.Println(tc.in)
+		})
+		fmt.Println(name)
+	}
+}
+`,
+			want: `package t
+
+import "testing"
+
+func TestMap(t *testing.T) {
+	t.Parallel()
+	for name, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			fmt.Println(tc.in)
+		})
+		fmt.Println(name)
+	}
+}
+`,
+		},
+		{
+			testCase:       "copy the variable of a channel range and of an int range",
+			needFixLoopVar: true,
+			src: `package t
+
+import "testing"
+
+func TestChan(t *testing.T) {
+	for tc := range ch {
+		t.Run(tc.name, func(t *testing.T) {
+			fmt.Println(tc.in)
+		})
+	}
+
+	for i := range len(cases) {
+		t.Run(cases[i].name, func(t *testing.T) {
+			fmt.Println(cases[i].in)
+		})
+	}
+}
+`,
+			want: `package t
+
+import "testing"
+
+func TestChan(t *testing.T) {
+	t.Parallel()
+	for tc := range ch {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			fmt.Println(tc.in)
+		})
+	}
+
+	for i := range len(cases) {
+		i := i
+		t.Run(cases[i].name, func(t *testing.T) {
+			t.Parallel()
+			fmt.Println(cases[i].in)
+		})
+	}
+}
+`,
+		},
+		{
+			testCase:       "insert Parallel into the subtests of a range-over-func iterator",
+			needFixLoopVar: false,
+			src: `package t
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestIter(t *testing.T) {
+	for name, tc := range maps.All(cases) {
+		t.Run(name, func(t *testing.T) {
+			fmt.Println(tc.in)
+		})
+	}
+}
+`,
+			want: `package t
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestIter(t *testing.T) {
+	t.Parallel()
+	for name, tc := range maps.All(cases) {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			fmt.Println(tc.in)
+		})
+	}
+}
+`,
+		},
+		{
+			testCase:       "insert Parallel into the functions of a table ranged over",
+			needFixLoopVar: true,
+			src: `package t
+
+import "testing"
+
+func TestFuncs(t *testing.T) {
+	for name, fn := range map[string]func(*testing.T){
+		"foo": func(t *testing.T) {
+			fmt.Println("foo")
+		},
+		"bar": func(tt *testing.T) {
+			fmt.Println("bar")
+		},
+	} {
+		t.Run(name, fn)
+	}
+}
+`,
+			want: `package t
+
+import "testing"
+
+func TestFuncs(t *testing.T) {
+	t.Parallel()
+	for name, fn := range map[string]func(*testing.T){
+		"foo": func(t *testing.T) {
+			t.Parallel()
+			fmt.Println("foo")
+		},
+		"bar": func(tt *testing.T) {
+			tt.Parallel()
+			fmt.Println("bar")
+		},
+	} {
+		t.Run(name, fn)
+	}
+}
+`,
+		},
+		{
+			testCase:       "insert Parallel into the function fields of a table of structs",
+			needFixLoopVar: true,
+			src: `package t
+
+import "testing"
+
+func TestFields(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T)
+	}{
+		{name: "foo", run: func(t *testing.T) {
+			fmt.Println("foo")
+		}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, tc.run)
+	}
+}
+`,
+			want: `package t
+
+import "testing"
+
+func TestFields(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name string
+		run  func(t *testing.T)
+	}{
+		{name: "foo", run: func(t *testing.T) {
+			t.Parallel()
+			fmt.Println("foo")
+		}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, tc.run)
+	}
+}
+`,
+		},
+		{
+			testCase:       "leave the functions of a table alone if any of them is parallel or calls Setenv",
+			needFixLoopVar: true,
+			src: `package t
+
+import "testing"
+
+func TestFuncs(t *testing.T) {
+	funcs := []func(*testing.T){
+		func(t *testing.T) {
+			fmt.Println("foo")
+		},
+		func(t *testing.T) {
+			t.Setenv("FOO", "bar")
+		},
+	}
+
+	for _, fn := range funcs {
+		t.Run("", fn)
+	}
+}
+`,
+			want: `package t
+
+import "testing"
+
+func TestFuncs(t *testing.T) {
+	t.Parallel()
+	funcs := []func(*testing.T){
+		func(t *testing.T) {
+			fmt.Println("foo")
+		},
+		func(t *testing.T) {
+			t.Setenv("FOO", "bar")
+		},
+	}
+
+	for _, fn := range funcs {
+		t.Run("", fn)
+	}
+}
+`,
+		},
+		{
+			testCase:       "do not copy the loop variable of a subtest with a callback that is not a literal",
+			needFixLoopVar: true,
+			src: `package t
+
+import "testing"
+
+func TestFuncs(t *testing.T) {
+	for _, tc := range cases {
+		t.Run(tc.name, tc.run)
+	}
+}
+`,
+			want: `package t
+
+import "testing"
+
+func TestFuncs(t *testing.T) {
+	t.Parallel()
+	for _, tc := range cases {
+		t.Run(tc.name, tc.run)
+	}
+}
+`,
+		},
+		{
+			testCase:       "replace the defer statements releasing the state of the subtests made parallel with t.Cleanup",
+			needFixLoopVar: false,
+			src: `package t
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	defer func() {
+		fmt.Println("done")
+	}()
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			get(ctx, srv.URL)
+		})
+	}
+}
+`,
+			want: `package t
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(nil)
+	t.Cleanup(func() { srv.Close() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() { cancel() })
+
+	defer func() {
+		fmt.Println("done")
+	}()
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			get(ctx, srv.URL)
+		})
+	}
+}
+`,
+		},
+		{
+			testCase:       "replace the defer statements registered before the one replaced with t.Cleanup too",
+			needFixLoopVar: false,
+			src: `package t
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	db := openDB()
+	defer db.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	defer fmt.Println("done")
+
+	t.Run("1", func(t *testing.T) {
+		get(srv.URL)
+	})
+}
+`,
+			want: `package t
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	t.Parallel()
+	db := openDB()
+	t.Cleanup(func() { db.Close() })
+
+	srv := httptest.NewServer(nil)
+	t.Cleanup(func() { srv.Close() })
+
+	defer fmt.Println("done")
+
+	t.Run("1", func(t *testing.T) {
+		t.Parallel()
+		get(srv.URL)
+	})
+}
+`,
+		},
+		{
+			testCase:       "leave the defer statements as is when one registered before cannot be replaced with t.Cleanup",
+			needFixLoopVar: false,
+			src: `package t
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatal(r)
+		}
+	}()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	t.Run("1", func(t *testing.T) {
+		get(srv.URL)
+	})
+}
+`,
+			want: `package t
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	t.Parallel()
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatal(r)
+		}
+	}()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	t.Run("1", func(t *testing.T) {
+		t.Parallel()
+		get(srv.URL)
+	})
+}
+`,
+		},
+		{
+			testCase:       "copy the values the replaced defer statement evaluates when they change later",
+			needFixLoopVar: false,
+			src: `package t
+
+import (
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	dir := makeDir()
+	defer os.RemoveAll(dir)
+	defer log(time.Now())
+
+	for _, f := range files {
+		defer f.Close()
+	}
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	dir = "other"
+	srv = httptest.NewServer(nil)
+
+	t.Run("1", func(t *testing.T) {
+		get(srv.URL)
+	})
+}
+`,
+			want: `package t
+
+import (
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	t.Parallel()
+	dir := makeDir()
+	osRemoveAllArg := dir
+	t.Cleanup(func() { os.RemoveAll(osRemoveAllArg) })
+	logArg := time.Now()
+	t.Cleanup(func() { log(logArg) })
+
+	for _, f := range files {
+		fClose := f.Close
+		t.Cleanup(func() { fClose() })
+	}
+
+	srv := httptest.NewServer(nil)
+	srvClose := srv.Close
+	t.Cleanup(func() { srvClose() })
+
+	dir = "other"
+	srv = httptest.NewServer(nil)
+
+	t.Run("1", func(t *testing.T) {
+		t.Parallel()
+		get(srv.URL)
+	})
+}
+`,
+		},
+		{
+			testCase:       "leave the defer statements as is when no subtest is made parallel",
+			needFixLoopVar: false,
+			src: `package t
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	t.Run("1", func(t *testing.T) {
+		t.Parallel()
+		get(srv.URL)
+	})
+}
+`,
+			want: `package t
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	t.Run("1", func(t *testing.T) {
+		t.Parallel()
+		get(srv.URL)
+	})
+}
+`,
+		},
+		{
+			testCase:       "leave the deferred functions calling recover as is",
+			needFixLoopVar: false,
+			src: `package t
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	srv := httptest.NewServer(nil)
+	defer func() {
+		if r := recover(); r != nil {
+			srv.Close()
+		}
+	}()
+
+	t.Run("1", func(t *testing.T) {
+		get(srv.URL)
+	})
+}
+`,
+			want: `package t
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(nil)
+	defer func() {
+		if r := recover(); r != nil {
+			srv.Close()
+		}
+	}()
+
+	t.Run("1", func(t *testing.T) {
+		t.Parallel()
+		get(srv.URL)
+	})
+}
+`,
+		},
+		{
+			testCase:       "wrap the loop in a group subtest when the test has statements running after it",
+			needFixLoopVar: false,
+			opts:           []GenerateOption{WithSubtestGroups()},
+			src: `package t
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			get(srv.URL, tc.in)
+		})
+	}
+
+	if calls != len(cases) {
+		t.Error("calls")
+	}
+}
+
+func TestNoGroup(t *testing.T) {
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			get(tc.in)
+		})
+	}
+}
+`,
+			want: `package t
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	t.Run("group", func(t *testing.T) {
+		for _, tc := range cases {
+			t.Run(tc.name, func(t *testing.T) {
+				t.Parallel()
+				get(srv.URL, tc.in)
+			})
+		}
+	})
+
+	if calls != len(cases) {
+		t.Error("calls")
+	}
+}
+
+func TestNoGroup(t *testing.T) {
+	t.Parallel()
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			get(tc.in)
+		})
+	}
+}
+`,
+		},
+		{
+			testCase:       "do not wrap the loop in a group subtest when it has a return statement",
+			needFixLoopVar: false,
+			opts:           []GenerateOption{WithSubtestGroups()},
+			src: `package t
+
+import "testing"
+
+func TestGroup(t *testing.T) {
+	for _, tc := range cases {
+		if tc.skip {
+			return
+		}
+		t.Run(tc.name, func(t *testing.T) {
+			get(tc.in)
+		})
+	}
+
+	t.Log("done")
+}
+`,
+			want: `package t
+
+import "testing"
+
+func TestGroup(t *testing.T) {
+	t.Parallel()
+	for _, tc := range cases {
+		if tc.skip {
+			return
+		}
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			get(tc.in)
+		})
+	}
+
+	t.Log("done")
+}
+`,
+		},
+		{
+			testCase:       "do not wrap the loop in a group subtest when it has a labelled branch statement",
+			needFixLoopVar: false,
+			opts:           []GenerateOption{WithSubtestGroups()},
+			src: `package t
+
+import "testing"
+
+func TestGroup(t *testing.T) {
+	for _, tc := range cases {
+	inputs:
+		for _, in := range tc.ins {
+			if in == "" {
+				break inputs
+			}
+		}
+		t.Run(tc.name, func(t *testing.T) {
+			get(tc.in)
+		})
+	}
+
+	t.Log("done")
+}
+`,
+			want: `package t
+
+import "testing"
+
+func TestGroup(t *testing.T) {
+	t.Parallel()
+	for _, tc := range cases {
+	inputs:
+		for _, in := range tc.ins {
+			if in == "" {
+				break inputs
+			}
+		}
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			get(tc.in)
+		})
+	}
+
+	t.Log("done")
+}
+`,
+		},
+		{
+			testCase:       "do not wrap the loop in a group subtest when it has a goto statement",
+			needFixLoopVar: false,
+			opts:           []GenerateOption{WithSubtestGroups()},
+			src: `package t
+
+import "testing"
+
+func TestGroup(t *testing.T) {
+	for _, tc := range cases {
+		if tc.skip {
+			goto done
+		}
+		t.Run(tc.name, func(t *testing.T) {
+			get(tc.in)
+		})
+	}
+
+done:
+	t.Log("done")
+}
+`,
+			want: `package t
+
+import "testing"
+
+func TestGroup(t *testing.T) {
+	t.Parallel()
+	for _, tc := range cases {
+		if tc.skip {
+			goto done
+		}
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			get(tc.in)
+		})
+	}
+
+done:
+	t.Log("done")
+}
+`,
+		},
+		{
+			testCase:       "do not wrap the loop in a group subtest when it has a defer statement",
+			needFixLoopVar: false,
+			opts:           []GenerateOption{WithSubtestGroups()},
+			src: `package t
+
+import "testing"
+
+func TestGroup(t *testing.T) {
+	for _, tc := range cases {
+		defer unlock()
+		t.Run(tc.name, func(t *testing.T) {
+			get(tc.in)
+		})
+	}
+
+	t.Log("done")
+}
+`,
+			want: `package t
+
+import "testing"
+
+func TestGroup(t *testing.T) {
+	t.Parallel()
+	for _, tc := range cases {
+		defer unlock()
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			get(tc.in)
+		})
+	}
+
+	t.Log("done")
+}
+`,
+		},
+		{
+			testCase:       "do not wrap the loop in a group subtest when it has a use of the test outside Run",
+			needFixLoopVar: false,
+			opts:           []GenerateOption{WithSubtestGroups()},
+			src: `package t
+
+import "testing"
+
+func TestGroup(t *testing.T) {
+	for _, tc := range cases {
+		if tc.name == "" {
+			t.Fatal("no name")
+		}
+		t.Run(tc.name, func(t *testing.T) {
+			get(tc.in)
+		})
+	}
+
+	t.Log("done")
+}
+`,
+			want: `package t
+
+import "testing"
+
+func TestGroup(t *testing.T) {
+	t.Parallel()
+	for _, tc := range cases {
+		if tc.name == "" {
+			t.Fatal("no name")
+		}
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			get(tc.in)
+		})
+	}
+
+	t.Log("done")
+}
+`,
+		},
+		{
+			testCase:       "leave the subtests as is when the test reads their results after the loop",
+			needFixLoopVar: false,
+			src: `package t
+
+import "testing"
+
+func TestResults(t *testing.T) {
+	var got []string
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got = append(got, tc.name)
+		})
+	}
+
+	if len(got) != len(cases) {
+		t.Error("missing")
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	count := 0
+	t.Cleanup(func() {
+		if count != len(cases) {
+			t.Error("missing")
+		}
+	})
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			count++
+		})
+	}
+}
+`,
+			want: `package t
+
+import "testing"
+
+func TestResults(t *testing.T) {
+	t.Parallel()
+	var got []string
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got = append(got, tc.name)
+		})
+	}
+
+	if len(got) != len(cases) {
+		t.Error("missing")
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	t.Parallel()
+	count := 0
+	t.Cleanup(func() {
+		if count != len(cases) {
+			t.Error("missing")
+		}
+	})
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			count++
+		})
+	}
+}
+`,
+		},
+		{
+			testCase:       "wrap the loop in a group subtest when the test reads the results of its subtests after it",
+			needFixLoopVar: false,
+			opts:           []GenerateOption{WithSubtestGroups()},
+			src: `package t
+
+import "testing"
+
+func TestResults(t *testing.T) {
+	results := map[string]bool{}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			results[tc.name] = true
+		})
+	}
+
+	defer check(results)
+}
+`,
+			want: `package t
+
+import "testing"
+
+func TestResults(t *testing.T) {
+	t.Parallel()
+	results := map[string]bool{}
+	t.Run("group", func(t *testing.T) {
+		for _, tc := range cases {
+			t.Run(tc.name, func(t *testing.T) {
+				t.Parallel()
+				results[tc.name] = true
+			})
+		}
+	})
+
+	defer check(results)
+}
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testCase, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := GenerateTParallel("./testdata/t/t_test.go", []byte(tt.src), tt.needFixLoopVar, tt.opts...)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if !reflect.DeepEqual(got, []byte(tt.want)) {
+				t.Errorf("result:\n%v, want:\n%v", string(got), tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessReportsHazards(t *testing.T) {
+	t.Parallel()
+
+	src := `package t
+
+import (
+	"flag"
+	"testing"
+)
+
+var counter int
+
+func reset() {
+	counter = 0
+}
+
+func TestHazards(t *testing.T) {
+	flag.Set("v", "1")
+	t.Run("1", func(t *testing.T) {
+		reset()
+	})
+}
+`
+
+	var got []string
+	if _, err := GenerateTParallel("./testdata/t/t_test.go", []byte(src), false, WithDiagnostics(func(d Diagnostic) {
+		got = append(got, d.String())
+	})); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	want := []string{
+		"./testdata/t/t_test.go:15:2: TestHazards calls flag.Set, which changes process-wide state, not parallelised",
+		"./testdata/t/t_test.go:11:2: TestHazards writes package-level variable counter (via reset), not parallelised",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("result:\n%v, want:\n%v", got, want)
+	}
+}
+
+func TestProcessReportsCaptures(t *testing.T) {
+	t.Parallel()
+
+	src := `package t
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCaptures(t *testing.T) {
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	var seen []string
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			get(srv.URL, seen)
+		})
+		seen = append(seen, tc.name)
+	}
+}
+`
+
+	var got []string
+	if _, err := GenerateTParallel("./testdata/t/t_test.go", []byte(src), false, WithParentDefersKept(), WithDiagnostics(func(d Diagnostic) {
+		got = append(got, d.String())
+	})); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	want := []string{
+		"./testdata/t/t_test.go:10:2: TestCaptures defers srv.Close(), which runs before the parallel subtests using srv; use t.Cleanup",
+		"./testdata/t/t_test.go:17:3: TestCaptures changes seen, which its parallel subtests use, while they may run",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("result:\n%v, want:\n%v", got, want)
+	}
+}
+
+func TestProcessReportsAssigningRangeLoops(t *testing.T) {
+	t.Parallel()
+
+	src := `package t
+
+import "testing"
+
+func TestAssign(t *testing.T) {
+	var tc testCase
+	t.Run("first", func(t *testing.T) {
+		fmt.Println(tc.name)
+	})
+	for _, tc = range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			fmt.Println(tc.name)
+		})
+	}
+}
+`
+
+	var got []string
+	if _, err := GenerateTParallel("./testdata/t/t_test.go", []byte(src), false, WithDiagnostics(func(d Diagnostic) {
+		got = append(got, d.String())
+	})); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	want := []string{
+		"./testdata/t/t_test.go:11:3: TestAssign registers the subtest tc.name using tc, which its range loop assigns with = while it may run, not parallelised",
+		"./testdata/t/t_test.go:10:2: TestAssign changes tc, which its parallel subtests use, while they may run",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("result:\n%v, want:\n%v", got, want)
+	}
+}
+
+func TestProcessReportsSubtestResults(t *testing.T) {
+	t.Parallel()
+
+	src := `package t
+
+import "testing"
+
+func TestResults(t *testing.T) {
+	var failed int
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if !tc.ok {
+				failed++
+			}
+		})
+	}
+
+	t.Log(failed)
+}
+`
+
+	for _, tt := range []struct {
+		opts []GenerateOption
+		want string
+	}{
+		{want: "./testdata/t/t_test.go:15:8: TestResults reads failed after the loop at line 7, whose subtests write it, not parallelised"},
+		{opts: []GenerateOption{WithInsertDespiteSubtestResults()}, want: "./testdata/t/t_test.go:15:8: TestResults reads failed after the loop at line 7, whose subtests write it"},
+	} {
+		var got []string
+		if _, err := GenerateTParallel("./testdata/t/t_test.go", []byte(src), false, append(tt.opts, WithDiagnostics(func(d Diagnostic) {
+			got = append(got, d.String())
+		}))...); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if !reflect.DeepEqual(got, []string{tt.want}) {
+			t.Errorf("result:\n%v, want:\n%v", got, tt.want)
+		}
+	}
+}
+
+//nolint:paralleltest // changes the working directory, from which the imports are resolved.
+func TestProcessDetectsParallelHelpersOfImportedPackages(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"go.mod": "module example.com/m\n\ngo 1.22\n",
+		"testutil/testutil.go": `package testutil
+
+import "testing"
+
+func Parallel(t *testing.T) {
+	t.Parallel()
+}
+`,
+	}
+	for name, src := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatalf("failed to create dir: %v", err)
+		}
+		if err := os.WriteFile(p, []byte(src), 0o644); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+	}
+
+	src := `package foo
+
+import (
+	"testing"
+
+	"example.com/m/testutil"
+)
+
+func TestFoo(t *testing.T) {
+	testutil.Parallel(t)
+}
+`
+
+	path := filepath.Join(dir, "foo", "foo_test.go")
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatalf("failed to create dir: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("failed to get working directory: %v", err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("failed to change directory: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Fatalf("failed to restore directory: %v", err)
+		}
+	})
+
+	got, err := GenerateTParallel(path, []byte(src), false, WithParallelHelperDetection())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if string(got) != src {
+		t.Errorf("result:\n%s, want:\n%s", got, src)
+	}
+}
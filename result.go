@@ -0,0 +1,164 @@
+package tparagen
+
+import (
+	"fmt"
+	"go/ast"
+)
+
+// WithInsertDespiteSubtestResults makes GenerateTParallel parallelise the subtests of the loops
+// whose results the test reads after the loop anyway. The reads are still reported.
+func WithInsertDespiteSubtestResults() GenerateOption {
+	return func(o *generateOptions) {
+		o.insertDespiteSubtestResults = true
+	}
+}
+
+// findSubtestResult returns a read, after r, a statement of body, of a local variable written by
+// the subtests r registers by calling Run on testVar, such as a slice of results checked after the loop.
+// Parallel subtests only write it after the function of body returns. The reads in the statements
+// after r and in the deferred calls count, but not in the cleanup functions, which run after the subtests.
+func (s *pkgScope) findSubtestResult(body *ast.BlockStmt, r *ast.RangeStmt, testVar string) (hazard, bool) {
+	written := map[*ast.Object]bool{}
+
+	ast.Inspect(r, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok || !hasRunMethod(call, testVar) || len(call.Args) != 2 {
+			return true
+		}
+
+		funcs, _ := s.tableFuncs([]*ast.RangeStmt{r}, call.Args[1])
+		if fun, ok := call.Args[1].(*ast.FuncLit); ok {
+			funcs = []*ast.FuncLit{fun}
+		}
+
+		for _, fun := range funcs {
+			s.collectWrites(fun, written)
+		}
+
+		return false
+	})
+
+	if len(written) == 0 {
+		return hazard{}, false
+	}
+
+	var (
+		read  *ast.Ident
+		after bool
+	)
+
+	for _, stmt := range body.List {
+		ast.Inspect(stmt, func(n ast.Node) bool {
+			if read != nil {
+				return false
+			}
+
+			switch n := n.(type) {
+			case *ast.CallExpr:
+				// The cleanup functions run after the subtests.
+				if exprCallHasMethod(n, testVar, "Cleanup") {
+					return false
+				}
+			case *ast.DeferStmt:
+				read = referencedVar(n.Call, written)
+
+				return false
+			case *ast.FuncLit:
+				return after
+			case *ast.Ident:
+				if after && n.Obj != nil && written[n.Obj] {
+					read = n
+				}
+			}
+
+			return true
+		})
+
+		if read != nil {
+			break
+		}
+
+		after = after || stmt == r
+	}
+
+	if read == nil {
+		return hazard{}, false
+	}
+
+	return hazard{
+		pos:     read.Pos(),
+		message: fmt.Sprintf("reads %s after the loop at line %d, whose subtests write it", read.Name, s.fs.Position(r.Pos()).Line),
+	}, true
+}
+
+// collectWrites adds to written the variables declared outside fun that fun assigns, increments,
+// or deletes or clears the elements of.
+func (s *pkgScope) collectWrites(fun *ast.FuncLit, written map[*ast.Object]bool) {
+	add := func(expr ast.Expr) {
+		id, ok := rootIdent(expr)
+		if !ok || s.isGlobal(id) || id.Obj.Kind != ast.Var {
+			return
+		}
+
+		if decl, ok := id.Obj.Decl.(ast.Node); ok && (decl.Pos() < fun.Pos() || fun.End() < decl.Pos()) {
+			written[id.Obj] = true
+		}
+	}
+
+	ast.Inspect(fun.Body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.AssignStmt:
+			for _, lhs := range n.Lhs {
+				add(lhs)
+			}
+		case *ast.IncDecStmt:
+			add(n.X)
+		case *ast.CallExpr:
+			if id, ok := n.Fun.(*ast.Ident); ok && id.Obj == nil && (id.Name == "delete" || id.Name == "clear") && len(n.Args) > 0 {
+				add(n.Args[0])
+			}
+		}
+
+		return true
+	})
+}
+
+// referencedVar returns an identifier in n referring to one of vars.
+func referencedVar(n ast.Node, vars map[*ast.Object]bool) *ast.Ident {
+	var found *ast.Ident
+
+	ast.Inspect(n, func(n ast.Node) bool {
+		if id, ok := n.(*ast.Ident); ok && id.Obj != nil && vars[id.Obj] {
+			found = id
+		}
+
+		return found == nil
+	})
+
+	return found
+}
+
+// skipSubtestResults reports whether to leave as is the subtests registered with testVar in r,
+// a loop of decl, because decl reads their results after the loop. The read is reported.
+func (o *generateOptions) skipSubtestResults(scope *pkgScope, decl *ast.FuncDecl, r *ast.RangeStmt, testVar string) bool {
+	h, ok := scope.findSubtestResult(decl.Body, r, testVar)
+	if !ok {
+		return false
+	}
+
+	o.report(scope.fs, h.pos, decl.Name.Name, CategorySubtestResult, h.message, !o.insertDespiteSubtestResults)
+
+	return !o.insertDespiteSubtestResults
+}
+
+// helperSkipsSubtestResults reports whether to leave helper, a function registering subtests with testVar,
+// as is because it reads the results of the subtests of any of its loops after the loop.
+func (o *generateOptions) helperSkipsSubtestResults(scope *pkgScope, helper *ast.FuncDecl, testVar string) bool {
+	for _, stmt := range helper.Body.List {
+		if r, ok := stmt.(*ast.RangeStmt); ok && o.skipSubtestResults(scope, helper, r, testVar) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,181 @@
+package tparagen
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// rewriteStore holds the rewritten files until they are applied.
+// Rewritten contents are kept in memory up to limit bytes in total;
+// beyond that, they are written to temporary files right away.
+// It is safe for concurrent use.
+type rewriteStore struct {
+	mu       sync.Mutex
+	files    map[string]*pendingRewrite
+	inMemory int64
+	limit    int64
+}
+
+// pendingRewrite is a rewritten file waiting to be applied.
+type pendingRewrite struct {
+	info fs.FileInfo
+	// data is the rewritten contents while it is held in memory.
+	data []byte
+	// tmpPath is the temporary file holding the rewritten contents once it is written to disk.
+	tmpPath string
+}
+
+func newRewriteStore(limit int64) *rewriteStore {
+	return &rewriteStore{
+		files: map[string]*pendingRewrite{},
+		limit: limit,
+	}
+}
+
+// add records b as the rewritten contents of path.
+func (s *rewriteStore) add(path string, info fs.FileInfo, b []byte) error {
+	s.mu.Lock()
+	inMemory := s.inMemory+int64(len(b)) <= s.limit
+	if inMemory {
+		s.inMemory += int64(len(b))
+		s.files[path] = &pendingRewrite{info: info, data: b}
+	}
+	s.mu.Unlock()
+
+	if inMemory {
+		return nil
+	}
+
+	tmpPath, err := writeTempFile(path, info, b)
+
+	s.mu.Lock()
+	s.files[path] = &pendingRewrite{info: info, tmpPath: tmpPath}
+	s.mu.Unlock()
+
+	return err
+}
+
+// stage writes the rewrites still held in memory to temporary files and returns
+// the temporary file path of every rewritten file.
+// key: original file path, value: temporary file path
+func (s *rewriteStore) stage() (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	staged := make(map[string]string, len(s.files))
+
+	for path, r := range s.files {
+		if r.tmpPath == "" {
+			tmpPath, err := writeTempFile(path, r.info, r.data)
+			r.tmpPath = tmpPath
+			if err != nil {
+				return nil, err
+			}
+
+			s.inMemory -= int64(len(r.data))
+			r.data = nil
+		}
+
+		staged[path] = r.tmpPath
+	}
+
+	return staged, nil
+}
+
+// cleanup removes all temporary files.
+func (s *rewriteStore) cleanup() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, r := range s.files {
+		if r.tmpPath != "" {
+			os.Remove(r.tmpPath)
+		}
+	}
+}
+
+// writeTempFile writes the rewritten contents of path into a temporary file
+// created in the same directory, so that it can later be renamed over the
+// original without crossing filesystems. The temporary file gets the mode and,
+// where supported, the ownership of the original file.
+// The temporary file path is returned even on failure so that it can be cleaned up.
+func writeTempFile(path string, info fs.FileInfo, b []byte) (string, error) {
+	tmpf, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tparagen-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp file for %s. %w", path, err)
+	}
+	defer tmpf.Close()
+
+	if _, err := tmpf.Write(b); err != nil {
+		return tmpf.Name(), fmt.Errorf("failed to write temp file for %s. %w", path, err)
+	}
+
+	// Changing the owner may clear the setuid and setgid bits, so the mode is set afterwards.
+	if err := chown(tmpf, info); err != nil {
+		return tmpf.Name(), fmt.Errorf("failed to set ownership of temp file for %s. %w", path, err)
+	}
+
+	if err := tmpf.Chmod(info.Mode().Perm()); err != nil {
+		return tmpf.Name(), fmt.Errorf("failed to set permissions of temp file for %s. %w", path, err)
+	}
+
+	if err := tmpf.Sync(); err != nil {
+		return tmpf.Name(), fmt.Errorf("failed to sync temp file for %s. %w", path, err)
+	}
+
+	return tmpf.Name(), nil
+}
+
+// renameFile renames oldpath to newpath. If they are on different filesystems,
+// the contents are copied and synced to newpath instead, and oldpath is removed.
+func renameFile(oldpath, newpath string) error {
+	err := os.Rename(oldpath, newpath)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	if err := copyFile(oldpath, newpath); err != nil {
+		return err
+	}
+
+	return os.Remove(oldpath)
+}
+
+// copyFile copies the contents and mode of src to dst and syncs dst to disk.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+
+		return err
+	}
+
+	if err := out.Sync(); err != nil {
+		out.Close()
+
+		return err
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,449 @@
+package tparagen
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+)
+
+// runHelperParam returns the name of the *testing.T parameter of decl, a function that is not a test,
+// if its body calls Run on it, such as func runCases(t *testing.T, cases []testCase).
+func (s *pkgScope) runHelperParam(decl *ast.FuncDecl) (string, bool) {
+	if decl.Recv != nil || decl.Body == nil {
+		return "", false
+	}
+
+	testingName := s.fileOf(decl.Pos()).testingName
+
+	for _, field := range decl.Type.Params.List {
+		star, ok := field.Type.(*ast.StarExpr)
+		if !ok || !isSelector(star.X, testingName, testMethodStruct) {
+			continue
+		}
+
+		for _, name := range field.Names {
+			var callsRun bool
+
+			ast.Inspect(decl.Body, func(n ast.Node) bool {
+				if !callsRun {
+					callsRun = hasRunMethod(n, name.Name)
+				}
+
+				return !callsRun
+			})
+
+			if callsRun {
+				return name.Name, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// parallelSafe reports whether funcDecl, a function of f, is a test entry point that
+// GenerateTParallel would parallelise or leave parallel.
+func (o *generateOptions) parallelSafe(scope *pkgScope, f *ast.File, funcDecl *ast.FuncDecl) bool {
+	if !isTparagenTargetFunc(funcDecl.Doc) || funcDecl.Body == nil {
+		return false
+	}
+
+	testVar, ok := o.testEntryPoint(f, funcDecl)
+	if !ok {
+		return false
+	}
+
+	if _, ok := scope.findBDDBootstrap(funcDecl.Body); ok && !o.insertIntoBDDSuites {
+		return false
+	}
+
+	if len(scope.findHazards(funcDecl.Body)) > 0 && !o.insertDespiteHazards {
+		return false
+	}
+
+	var setenv bool
+
+	ast.Inspect(funcDecl.Body, func(n ast.Node) bool {
+		// The subtests are not affected.
+		if setenv || hasRunMethod(n, testVar) {
+			return false
+		}
+
+		setenv = scope.hasSetenvCall(n, testVar)
+
+		return !setenv
+	})
+
+	return !setenv
+}
+
+// callersParallelSafe reports whether helper, a package-level function registering subtests with
+// testVar, is only called, and called at least once, by test entry points that are parallel-safe,
+// in any file of the package, and that neither release nor read the state they pass to it afterwards.
+func (o *generateOptions) callersParallelSafe(scope *pkgScope, helper *ast.FuncDecl, testVar string) bool {
+	called, safe := false, true
+	testArg := paramIndex(helper, testVar)
+
+	for _, file := range scope.files {
+		for _, decl := range file.ast.Decls {
+			caller, ok := decl.(*ast.FuncDecl)
+			if !ok || caller == helper || caller.Body == nil {
+				continue
+			}
+
+			var (
+				refs  int
+				calls []*ast.CallExpr
+			)
+
+			ast.Inspect(caller.Body, func(n ast.Node) bool {
+				switch n := n.(type) {
+				case *ast.CallExpr:
+					if id, ok := n.Fun.(*ast.Ident); ok && id.Name == helper.Name.Name && scope.isGlobal(id) {
+						calls = append(calls, n)
+					}
+				case *ast.Ident:
+					if n.Name == helper.Name.Name && scope.isGlobal(n) {
+						refs++
+					}
+				}
+
+				return true
+			})
+
+			if refs == 0 {
+				continue
+			}
+
+			called = true
+
+			// A reference other than a call, such as a function value, may run the subtests anywhere.
+			if refs != len(calls) || !o.parallelSafe(scope, file.ast, caller) {
+				safe = false
+
+				continue
+			}
+
+			callerTestVar, _ := o.testEntryPoint(file.ast, caller)
+
+			for _, call := range calls {
+				if h, ok := scope.findHelperArgUse(caller, call, testArg, callerTestVar); ok {
+					o.explain(scope.fs, h.pos, caller.Name.Name, nil, h.message)
+
+					safe = false
+
+					break
+				}
+			}
+		}
+	}
+
+	return called && safe
+}
+
+// findHelperArgUse returns a use by caller, a test with the *testing.T testVar, of the local variables
+// it passes to the helper registering subtests by call, other than the *testing.T argument at testArg:
+// a deferred call releasing them, or a read after call. The parallel subtests of the helper only
+// run after caller returns. The reads by the other calls of the helper and by the cleanup functions,
+// which run after the subtests, do not count.
+func (s *pkgScope) findHelperArgUse(caller *ast.FuncDecl, call *ast.CallExpr, testArg int, testVar string) (hazard, bool) {
+	var (
+		args   []ast.Expr
+		passed = map[*ast.Object]bool{}
+	)
+
+	for i, arg := range call.Args {
+		if i == testArg {
+			continue
+		}
+
+		args = append(args, arg)
+
+		ast.Inspect(arg, func(n ast.Node) bool {
+			if id, ok := n.(*ast.Ident); ok && !s.isGlobal(id) && id.Obj.Kind == ast.Var {
+				passed[id.Obj] = true
+			}
+
+			return true
+		})
+	}
+
+	helperName := nodeString(call.Fun)
+
+	var (
+		h     hazard
+		found bool
+	)
+
+	ast.Inspect(caller.Body, func(n ast.Node) bool {
+		if found || len(passed) == 0 {
+			return false
+		}
+
+		switch n := n.(type) {
+		case *ast.CallExpr:
+			if exprCallHasMethod(n, testVar, "Cleanup") || nodeString(n.Fun) == helperName {
+				return false
+			}
+		case *ast.DeferStmt:
+			released := s.releasedVars(n)
+
+			for _, arg := range args {
+				if v := referencedVar(arg, released); v != nil && !found {
+					h = hazard{
+						pos:     n.Pos(),
+						message: fmt.Sprintf("defers %s, which runs before the parallel subtests of %s using %s", nodeString(n.Call), helperName, v.Name),
+					}
+					found = true
+				}
+			}
+
+			return false
+		case *ast.Ident:
+			if n.Pos() > call.End() && n.Obj != nil && passed[n.Obj] {
+				h = hazard{
+					pos:     n.Pos(),
+					message: fmt.Sprintf("reads %s after passing it to %s, whose parallel subtests may not have run", n.Name, helperName),
+				}
+				found = true
+			}
+		}
+
+		return true
+	})
+
+	return h, found
+}
+
+// paramIndex returns the index of the parameter name of decl, or -1.
+func paramIndex(decl *ast.FuncDecl, name string) int {
+	i := 0
+
+	for _, field := range decl.Type.Params.List {
+		if len(field.Names) == 0 {
+			i++
+
+			continue
+		}
+
+		for _, n := range field.Names {
+			if n.Name == name {
+				return i
+			}
+
+			i++
+		}
+	}
+
+	return -1
+}
+
+// parallelizeSubtests inserts Parallel() into the subtests registered in node, a part of decl in f,
+// by calling Run on testVar, with literal callbacks or the functions of a table literal ranged over.
+// The loop variables captured by the literal callbacks are copied if needFixLoopVar is set.
+// It returns the subtests made parallel.
+func (o *generateOptions) parallelizeSubtests(scope *pkgScope, f *ast.File, rv *reviewer, decl *ast.FuncDecl, node ast.Node, testVar string,
+	needFixLoopVar bool, buildParallelStmt func(token.Pos, string) *ast.ExprStmt,
+) (subtests []parallelSubtest) {
+	var loops []*ast.RangeStmt
+
+	copied := map[*ast.Object]bool{}
+
+	var inspect func(n ast.Node) bool
+	inspect = func(n ast.Node) bool {
+		if r, ok := n.(*ast.RangeStmt); ok {
+			loops = append(loops, r)
+			ast.Inspect(r.Body, inspect)
+			loops = loops[:len(loops)-1]
+
+			return false
+		}
+
+		call, ok := n.(*ast.CallExpr)
+		if !ok || !hasRunMethod(call, testVar) || len(call.Args) != 2 {
+			return true
+		}
+
+		if scope.subtestOptedOut(call) {
+			o.explain(scope.fs, call.Pos(), decl.Name.Name, call.Args[0], "has a nolint directive, not parallelised")
+
+			return false
+		}
+
+		fun, ok := call.Args[1].(*ast.FuncLit)
+		if !ok {
+			// e.g. t.Run(name, fn) in for name, fn := range map[string]func(*testing.T){...}
+			funcs, ok := scope.tableFuncs(loops, call.Args[1])
+			if !ok {
+				o.explainCallback(scope.fs, decl, call)
+
+				return false
+			}
+
+			for _, fun := range funcs {
+				if scope.subtestSerial(fun, funcParamName(fun)) {
+					o.explainSerialSubtest(scope, decl, call, fun, funcParamName(fun))
+
+					return false
+				}
+			}
+
+			for _, fun := range funcs {
+				tpStmt := buildParallelStmt(fun.Body.Lbrace, funcParamName(fun))
+				if rv.accept(f, decl, EditParallel, call, fun.Body.Lbrace, tpStmt) {
+					fun.Body.List = append([]ast.Stmt{tpStmt}, fun.Body.List...)
+					subtests = append(subtests, parallelSubtest{run: call, fun: fun})
+				}
+			}
+
+			return false
+		}
+
+		innerTestVar := getRunCallbackParameterName(call)
+		if innerTestVar == "" {
+			o.explainCallback(scope.fs, decl, call)
+
+			return false
+		}
+
+		// The subtests nested in the subtest are not processed.
+		o.explainNested(scope, decl, call, fun, innerTestVar)
+
+		if scope.subtestSerial(fun, innerTestVar) {
+			o.explainSerialSubtest(scope, decl, call, fun, innerTestVar)
+
+			return false
+		}
+
+		// A range loop assigning to variables with = shares them with its iterations in any version of Go.
+		if v, ok := assignedLoopVar(loops, fun); ok {
+			o.report(scope.fs, call.Pos(), decl.Name.Name, CategoryCapturedState,
+				fmt.Sprintf("registers the subtest %s using %s, which its range loop assigns with = while it may run", nodeString(call.Args[0]), v), true)
+
+			return false
+		}
+
+		tpStmt := buildParallelStmt(fun.Body.Lbrace, innerTestVar)
+		if !rv.accept(f, decl, EditParallel, call, fun.Body.Lbrace, tpStmt) {
+			return false
+		}
+
+		fun.Body.List = append([]ast.Stmt{tpStmt}, fun.Body.List...)
+		subtests = append(subtests, parallelSubtest{run: call, fun: fun})
+
+		// https://tip.golang.org/doc/go1.22
+		// Loop variables captured by the subtest are shared by the iterations before Go 1.22.
+		if needFixLoopVar {
+			for _, r := range loops {
+				var copies []ast.Stmt
+
+				for _, v := range loopVarsReferenced(r, fun) {
+					if copied[v.Obj] {
+						continue
+					}
+
+					lv := buildLoopVarReAssignmentStmt(r.Body.Lbrace, v.Name)
+					if rv.accept(f, decl, EditLoopVarCopy, nil, r.Body.Lbrace, lv) {
+						copies = append(copies, lv)
+					}
+
+					copied[v.Obj] = true
+				}
+
+				// In the order of the declaration, such as name := name before tc := tc.
+				r.Body.List = append(copies, r.Body.List...)
+			}
+		}
+
+		return false
+	}
+
+	ast.Inspect(node, inspect)
+
+	return subtests
+}
+
+// subtestSerial reports whether fun, the callback of a subtest with the *testing.T parameter testVar,
+// already calls Parallel() or calls Setenv(), so that no Parallel() is inserted into it.
+func (s *pkgScope) subtestSerial(fun *ast.FuncLit, testVar string) bool {
+	var serial bool
+
+	ast.Inspect(fun.Body, func(n ast.Node) bool {
+		if !serial {
+			serial = s.hasParallelCall(n, testVar) || s.hasSetenvCall(n, testVar)
+		}
+
+		return !serial
+	})
+
+	return serial
+}
+
+// loopVarsReferenced returns the variables declared by r that are referenced in fun
+// and not copied at the beginning of the loop body yet.
+func loopVarsReferenced(r *ast.RangeStmt, fun *ast.FuncLit) []*ast.Ident {
+	if r.Tok != token.DEFINE {
+		return nil
+	}
+
+	var vars []*ast.Ident
+
+	for _, expr := range []ast.Expr{r.Key, r.Value} {
+		v, ok := expr.(*ast.Ident)
+		if !ok || v.Obj == nil || v.Name == "_" || loopVarCopied(r, v) {
+			continue
+		}
+
+		var referenced bool
+
+		ast.Inspect(fun.Body, func(n ast.Node) bool {
+			if id, ok := n.(*ast.Ident); ok && id.Obj == v.Obj {
+				referenced = true
+			}
+
+			return !referenced
+		})
+
+		if referenced {
+			vars = append(vars, v)
+		}
+	}
+
+	return vars
+}
+
+// assignedLoopVar returns the name of a variable that one of loops assigns with =,
+// such as tc in for _, tc = range cases, and fun refers to.
+func assignedLoopVar(loops []*ast.RangeStmt, fun *ast.FuncLit) (string, bool) {
+	assigned := map[*ast.Object]bool{}
+
+	for _, r := range loops {
+		if r.Tok != token.ASSIGN {
+			continue
+		}
+
+		for _, expr := range []ast.Expr{r.Key, r.Value} {
+			if id, ok := rootIdent(expr); ok && id.Obj != nil {
+				assigned[id.Obj] = true
+			}
+		}
+	}
+
+	return capturedVar(fun, assigned)
+}
+
+// loopVarCopied reports whether the body of r begins with copying v, such as tc := tc.
+func loopVarCopied(r *ast.RangeStmt, v *ast.Ident) bool {
+	for _, stmt := range r.Body.List {
+		assign, ok := stmt.(*ast.AssignStmt)
+		if !ok || assign.Tok != token.DEFINE || len(assign.Lhs) != 1 || len(assign.Rhs) != 1 {
+			return false
+		}
+
+		if rhs, ok := assign.Rhs[0].(*ast.Ident); ok && rhs.Obj == v.Obj {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,157 @@
+package tparagen
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// serialDirective marks a package whose tests must all stay serial. It is written in the
+// header of any test file of the package, before the package clause, such as in doc_test.go.
+const serialDirective = "//tparagen:serial"
+
+// serialPackage is the reason the test files of a package are left as is.
+type serialPackage struct {
+	pos token.Position
+	// name is the name of the package, or of the function deciding it.
+	name    string
+	message string
+}
+
+func (p *serialPackage) diagnostic() Diagnostic {
+	return Diagnostic{Pos: p.pos, Func: p.name, Category: CategorySerialPackage, Message: p.message, Skipped: true}
+}
+
+// findSerialPackage reports whether the test files in dir must stay serial because the package
+// defines TestMain, unless processTestMain is set, or is marked with serialDirective.
+// srcs replace the contents of the files on disk, keyed by their paths.
+func findSerialPackage(dir string, srcs map[string][]byte, processTestMain bool) (*serialPackage, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*_test.go"))
+	if err != nil {
+		return nil, err
+	}
+
+	for p := range srcs {
+		if filepath.Dir(p) == filepath.Clean(dir) && !slices.Contains(paths, p) {
+			paths = append(paths, p)
+		}
+	}
+
+	sort.Strings(paths)
+
+	var testMain *serialPackage
+
+	for _, p := range paths {
+		var src any
+		if b, ok := srcs[p]; ok {
+			src = b
+		}
+
+		fs := token.NewFileSet()
+
+		f, err := parser.ParseFile(fs, p, src, parser.ParseComments|parser.SkipObjectResolution)
+		if err != nil {
+			// The files that do not parse are reported when they are processed.
+			continue
+		}
+
+		if pos, ok := serialDirectivePos(f); ok {
+			return &serialPackage{
+				pos:     fs.Position(pos),
+				name:    "package " + f.Name.Name,
+				message: "is marked " + serialDirective,
+			}, nil
+		}
+
+		if testMain != nil || processTestMain {
+			continue
+		}
+
+		if decl, ok := testMainDecl(f); ok {
+			testMain = &serialPackage{
+				pos:     fs.Position(decl.Pos()),
+				name:    decl.Name.Name,
+				message: fmt.Sprintf("controls the tests of package %s, which may share its fixtures", strings.TrimSuffix(f.Name.Name, "_test")),
+			}
+		}
+	}
+
+	return testMain, nil
+}
+
+// serialDirectivePos returns the position of serialDirective in the header of f.
+func serialDirectivePos(f *ast.File) (token.Pos, bool) {
+	for _, cg := range f.Comments {
+		if cg.Pos() > f.Package {
+			break
+		}
+
+		for _, c := range cg.List {
+			if c.Text == serialDirective || strings.HasPrefix(c.Text, serialDirective+" ") {
+				return c.Pos(), true
+			}
+		}
+	}
+
+	return token.NoPos, false
+}
+
+// testMainDecl returns the declaration of func TestMain(m *testing.M) in f.
+func testMainDecl(f *ast.File) (*ast.FuncDecl, bool) {
+	testingName, ok := testingImportName(f)
+	if !ok {
+		return nil, false
+	}
+
+	for _, decl := range f.Decls {
+		d, ok := decl.(*ast.FuncDecl)
+		if !ok || d.Recv != nil || d.Name.Name != "TestMain" || len(d.Type.Params.List) != 1 {
+			continue
+		}
+
+		if star, ok := d.Type.Params.List[0].Type.(*ast.StarExpr); ok && isSelector(star.X, testingName, "M") {
+			return d, true
+		}
+	}
+
+	return nil, false
+}
+
+// serialPackages caches the package-level decisions by directory during a run.
+type serialPackages struct {
+	processTestMain bool
+	// report is called once with the decision of each serial package.
+	report func(Diagnostic)
+
+	m sync.Map // directory -> func() (*serialPackage, error)
+}
+
+// lookup returns the decision for the package in dir, analysing it on the first call.
+func (s *serialPackages) lookup(dir string) (*serialPackage, error) {
+	if s == nil {
+		return nil, nil
+	}
+
+	v, _ := s.m.LoadOrStore(dir, sync.OnceValues(func() (*serialPackage, error) {
+		p, err := findSerialPackage(dir, nil, s.processTestMain)
+		if err != nil {
+			return nil, fmt.Errorf("cannot analyse the package in %s. %w", dir, err)
+		}
+
+		if p != nil && s.report != nil {
+			s.report(p.diagnostic())
+		}
+
+		return p, nil
+	}))
+
+	find, _ := v.(func() (*serialPackage, error))
+
+	return find()
+}
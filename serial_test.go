@@ -0,0 +1,105 @@
+package tparagen
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testMainSrc = `package foo_test
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	os.Exit(m.Run())
+}
+`
+
+const serialDirectiveSrc = `//tparagen:serial
+
+// Package foo has tests sharing a database.
+package foo
+`
+
+func TestFindSerialPackage(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		testCase        string
+		files           map[string]string
+		srcs            map[string]string
+		processTestMain bool
+		want            string
+	}{
+		{
+			testCase: "no TestMain",
+			files:    map[string]string{"foo_test.go": rewritableTestSrc},
+		},
+		{
+			testCase: "TestMain",
+			files:    map[string]string{"foo_test.go": rewritableTestSrc, "main_test.go": testMainSrc},
+			want:     "main_test.go:8:1: TestMain controls the tests of package foo, which may share its fixtures, not parallelised",
+		},
+		{
+			testCase:        "TestMain processed",
+			files:           map[string]string{"foo_test.go": rewritableTestSrc, "main_test.go": testMainSrc},
+			processTestMain: true,
+		},
+		{
+			testCase:        "serial directive",
+			files:           map[string]string{"doc_test.go": serialDirectiveSrc, "foo_test.go": rewritableTestSrc},
+			processTestMain: true,
+			want:            "doc_test.go:1:1: package foo is marked //tparagen:serial, not parallelised",
+		},
+		{
+			testCase: "serial directive after the package clause",
+			files:    map[string]string{"doc_test.go": "package foo\n\n//tparagen:serial\n"},
+		},
+		{
+			testCase: "TestMain removed in the source",
+			files:    map[string]string{"main_test.go": testMainSrc},
+			srcs:     map[string]string{"main_test.go": rewritableTestSrc},
+		},
+		{
+			testCase: "TestMain added in the source of a new file",
+			files:    map[string]string{"foo_test.go": rewritableTestSrc},
+			srcs:     map[string]string{"main_test.go": testMainSrc},
+			want:     "main_test.go:8:1: TestMain controls the tests of package foo, which may share its fixtures, not parallelised",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testCase, func(t *testing.T) {
+			t.Parallel()
+
+			dir := t.TempDir()
+			for name, src := range tt.files {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0o644); err != nil {
+					t.Fatalf("failed to write test file: %v", err)
+				}
+			}
+
+			srcs := map[string][]byte{}
+			for name, src := range tt.srcs {
+				srcs[filepath.Join(dir, name)] = []byte(src)
+			}
+
+			p, err := findSerialPackage(dir, srcs, tt.processTestMain)
+			if err != nil {
+				t.Fatalf("findSerialPackage() returned error: %v", err)
+			}
+
+			var got string
+			if p != nil {
+				got = p.diagnostic().String()[len(dir)+1:]
+			}
+
+			if got != tt.want {
+				t.Errorf("result: %q, want: %q", got, tt.want)
+			}
+		})
+	}
+}
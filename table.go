@@ -0,0 +1,125 @@
+package tparagen
+
+import (
+	"go/ast"
+	"go/token"
+)
+
+// tableFuncs returns the function literals run as subtests by fn, the callback of a Run call given as
+// a variable of one of loops or a field of it, such as fn in
+//
+//	for name, fn := range map[string]func(*testing.T){...} {
+//		t.Run(name, fn)
+//	}
+//
+// or tc.run in a loop over a table of structs. The table is a composite literal or a local variable
+// initialised with one. The elements whose functions are not literals with a named parameter are left out.
+func (s *pkgScope) tableFuncs(loops []*ast.RangeStmt, fn ast.Expr) ([]*ast.FuncLit, bool) {
+	var field string
+
+	if sel, ok := fn.(*ast.SelectorExpr); ok {
+		fn, field = sel.X, sel.Sel.Name
+	}
+
+	v, ok := fn.(*ast.Ident)
+	if !ok || v.Obj == nil {
+		return nil, false
+	}
+
+	var table ast.Expr
+
+	for i := len(loops) - 1; i >= 0; i-- {
+		if value, ok := loops[i].Value.(*ast.Ident); ok && loops[i].Tok == token.DEFINE && value.Obj == v.Obj {
+			table = loops[i].X
+
+			break
+		}
+	}
+
+	lit, ok := s.compositeLit(table)
+	if !ok {
+		return nil, false
+	}
+
+	var funcs []*ast.FuncLit
+
+	for _, elt := range lit.Elts {
+		if kv, ok := elt.(*ast.KeyValueExpr); ok {
+			elt = kv.Value
+		}
+
+		if field != "" {
+			elt = fieldValue(elt, field)
+		}
+
+		if fun, ok := elt.(*ast.FuncLit); ok && funcParamName(fun) != "" {
+			funcs = append(funcs, fun)
+		}
+	}
+
+	return funcs, len(funcs) > 0
+}
+
+// compositeLit returns the composite literal expr is, or the one initialising the local variable expr refers to.
+func (s *pkgScope) compositeLit(expr ast.Expr) (*ast.CompositeLit, bool) {
+	if p, ok := expr.(*ast.ParenExpr); ok {
+		return s.compositeLit(p.X)
+	}
+
+	if id, ok := expr.(*ast.Ident); ok && !s.isGlobal(id) && id.Obj.Kind == ast.Var {
+		switch decl := id.Obj.Decl.(type) {
+		case *ast.AssignStmt:
+			for i, lhs := range decl.Lhs {
+				if l, ok := lhs.(*ast.Ident); ok && l.Obj == id.Obj && len(decl.Rhs) == len(decl.Lhs) {
+					expr = decl.Rhs[i]
+				}
+			}
+		case *ast.ValueSpec:
+			for i, name := range decl.Names {
+				if name.Obj == id.Obj && len(decl.Values) == len(decl.Names) {
+					expr = decl.Values[i]
+				}
+			}
+		}
+	}
+
+	lit, ok := expr.(*ast.CompositeLit)
+
+	return lit, ok
+}
+
+// fieldValue returns the value of field in elt, a struct literal with keyed fields or a pointer to one.
+func fieldValue(elt ast.Expr, field string) ast.Expr {
+	if u, ok := elt.(*ast.UnaryExpr); ok && u.Op == token.AND {
+		elt = u.X
+	}
+
+	lit, ok := elt.(*ast.CompositeLit)
+	if !ok {
+		return nil
+	}
+
+	for _, e := range lit.Elts {
+		if kv, ok := e.(*ast.KeyValueExpr); ok {
+			if key, ok := kv.Key.(*ast.Ident); ok && key.Name == field {
+				return kv.Value
+			}
+		}
+	}
+
+	return nil
+}
+
+// funcParamName returns the name of the first parameter of fun, taken as its *testing.T,
+// or an empty string if it is unnamed.
+func funcParamName(fun *ast.FuncLit) string {
+	if len(fun.Type.Params.List) < 1 || len(fun.Type.Params.List[0].Names) < 1 {
+		return ""
+	}
+
+	if name := fun.Type.Params.List[0].Names[0].Name; name != "_" {
+		return name
+	}
+
+	return ""
+}
@@ -9,38 +9,135 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
 	"sync"
 
 	"github.com/saracen/walker"
+	"golang.org/x/sync/errgroup"
 )
 
 const (
 	defaultTargetDir     = "./"
 	defaultIgnoreDir     = "testdata"
 	fixingForLoopVersion = 1.22
+	backupSuffix         = ".tparagen.bak"
+
+	defaultPendingMemoryLimit = 64 << 20 // 64MiB
+	// dirFilesMemoryLimit is the total size of the Go files of the directories kept in memory
+	// for the analyses across the files of a package.
+	dirFilesMemoryLimit = 64 << 20 // 64MiB
 )
 
+// Option configures Run.
+type Option func(*tparagen)
+
+// WithJobs sets the number of test files processed concurrently.
+// If n is less than 1, runtime.GOMAXPROCS(0) is used.
+func WithJobs(n int) Option {
+	return func(t *tparagen) {
+		t.jobs = n
+	}
+}
+
+// WithSince limits the run to the test files changed since the git revision ref,
+// including uncommitted and untracked changes.
+func WithSince(ref string) Option {
+	return func(t *tparagen) {
+		t.since = ref
+	}
+}
+
+// WithStaged limits the run to the test files with changes staged in the git index.
+func WithStaged() Option {
+	return func(t *tparagen) {
+		t.staged = true
+	}
+}
+
+// WithChangedFuncsOnly limits the rewrite of the test files selected by
+// WithSince or WithStaged to the functions containing changed lines.
+func WithChangedFuncsOnly() Option {
+	return func(t *tparagen) {
+		t.changedFuncsOnly = true
+	}
+}
+
+// WithCacheDir sets the directory where the files that need no change are recorded,
+// so that they are skipped on the next run. An empty dir disables the cache.
+// By default, a directory under the user cache directory is used.
+func WithCacheDir(dir string) Option {
+	return func(t *tparagen) {
+		t.cacheDir = dir
+	}
+}
+
+// WithInteractive makes Run show each statement to be inserted on outStream and
+// ask whether to insert it, reading the answers from in.
+// Test files are processed one at a time.
+func WithInteractive(in io.Reader) Option {
+	return func(t *tparagen) {
+		t.prompter = newPrompter(in, t.outStream)
+	}
+}
+
+// WithVerify makes Run run the tests of each package with the rewrites applied, using
+// go test -race -count=count with an overlay, before applying them. The rewrites are
+// applied only to the packages whose tests pass; the others are reported for manual attention.
+func WithVerify(count int) Option {
+	return func(t *tparagen) {
+		t.verifyCount = max(count, 1)
+	}
+}
+
+// WithProcessTestMainPackages makes Run parallelise the tests of the packages defining TestMain,
+// which are left as is by default because TestMain may set up fixtures shared by the tests.
+func WithProcessTestMainPackages() Option {
+	return func(t *tparagen) {
+		t.processTestMain = true
+	}
+}
+
+// WithGenerateOptions sets the options GenerateTParallel is called with for each test file.
+func WithGenerateOptions(opts ...GenerateOption) Option {
+	return func(t *tparagen) {
+		t.genOpts = append(t.genOpts, opts...)
+	}
+}
+
 // Run is entry point.
-func Run(ctx context.Context, outStream, errStream io.Writer, ignoreDirectories []string, minGoVersion float64) error {
+func Run(ctx context.Context, outStream, errStream io.Writer, ignoreDirectories []string, minGoVersion float64, opts ...Option) error {
 	ignoreDirs := []string{defaultIgnoreDir}
 	if len(ignoreDirs) != 0 {
 		ignoreDirs = append(ignoreDirs, ignoreDirectories...)
 	}
 
+	t := newTparagen(outStream, errStream, minGoVersion, opts...)
+	t.ignoreDirs = ignoreDirs
+
+	return t.run(ctx)
+}
+
+func newTparagen(outStream, errStream io.Writer, minGoVersion float64, opts ...Option) *tparagen {
 	t := &tparagen{
-		in:         defaultTargetDir,
-		dest:       "",
-		outStream:  outStream,
-		errStream:  errStream,
-		ignoreDirs: ignoreDirs,
+		in:                 defaultTargetDir,
+		dest:               "",
+		outStream:          outStream,
+		errStream:          errStream,
+		pendingMemoryLimit: defaultPendingMemoryLimit,
+		cacheDir:           defaultCacheDir(),
 	}
 
 	if minGoVersion < fixingForLoopVersion {
 		t.needFixLoopVar = true
 	}
 
-	return t.run(ctx)
+	for _, opt := range opts {
+		opt(t)
+	}
+
+	return t
 }
 
 type tparagen struct {
@@ -48,36 +145,145 @@ type tparagen struct {
 	outStream, errStream io.Writer
 	ignoreDirs           []string
 	needFixLoopVar       bool
+
+	// jobs is the number of test files processed concurrently.
+	jobs int
+	// pendingMemoryLimit is the total size of rewritten files kept in memory
+	// until they are applied. Rewrites beyond the limit are written to temporary files.
+	pendingMemoryLimit int64
+
+	// since and staged select the test files changed according to git.
+	since  string
+	staged bool
+	// changedFuncsOnly limits the rewrite to the functions changed according to git.
+	changedFuncsOnly bool
+
+	// prompter asks whether to insert each statement in the interactive mode.
+	prompter *prompter
+
+	// verifyCount is the -count of go test run to verify the rewrites. 0 means no verification.
+	verifyCount int
+	// verifyNoRace disables the race detector in the verification. It is used by tests.
+	verifyNoRace bool
+
+	// genOpts are the options of GenerateTParallel given by the user.
+	genOpts []GenerateOption
+	// processTestMain parallelises the tests of the packages defining TestMain too.
+	processTestMain bool
+	// serialPkgs are the package-level decisions made during the run.
+	serialPkgs *serialPackages
+	// dirFiles caches the Go files of the directories for the analyses across the files of a package.
+	dirFiles dirFileCache
+
+	// reportMu serializes the reports of the findings written to outStream.
+	reportMu sync.Mutex
+	// bddSuites are the findings about the tests bootstrapping BDD frameworks, guarded by reportMu.
+	// They are reported together at the end of the scan.
+	bddSuites []Diagnostic
+
+	// cacheDir is the directory of the result cache. Empty means no cache.
+	cacheDir string
+
+	// renameFunc replaces os.Rename when set. It is used by tests to simulate failures.
+	renameFunc func(oldpath, newpath string) error
 }
 
 func (t *tparagen) run(ctx context.Context) error {
-	// Information of files to be modified
-	// key: original file path, value: temporary file path
-	// walker.Walk() may execute concurrently, so sync.Map is used.
-	var tempFiles sync.Map
+	cache := newResultCache(t.cacheDir)
+	if t.prompter != nil {
+		// Files where every edit was declined must be asked about again on the next run.
+		cache = nil
+	}
 
+	rewrites := newRewriteStore(t.pendingMemoryLimit)
 	// remove all temporary files
-	defer func() {
-		tempFiles.Range(func(_, p any) bool {
-			path, ok := p.(string)
-			if !ok {
-				return false
-			}
+	defer rewrites.cleanup()
 
-			// Remove temporary files
-			os.Remove(path)
+	t.serialPkgs = &serialPackages{
+		processTestMain: t.processTestMain,
+		report: func(d Diagnostic) {
+			t.report([]Diagnostic{d})
+		},
+	}
 
-			return true
+	g, gctx := errgroup.WithContext(ctx)
+
+	// Discovery and processing are separated so that the number of files
+	// open at the same time is bounded by the number of workers.
+	targets := make(chan target)
+
+	g.Go(func() error {
+		defer close(targets)
+
+		if t.gitMode() {
+			return t.discoverChanged(gctx, targets)
+		}
+
+		return t.discover(gctx, targets)
+	})
+
+	for range t.workers() {
+		g.Go(func() error {
+			for target := range targets {
+				// Abort early on interruption (SIGINT/SIGTERM). Returning here
+				// lets the deferred cleanup remove any temporary files created so far.
+				if err := gctx.Err(); err != nil {
+					return err
+				}
+
+				if err := t.process(target, cache, rewrites); err != nil {
+					return err
+				}
+			}
+
+			return nil
 		})
-	}()
+	}
 
-	if err := walker.Walk(t.in, func(path string, info fs.FileInfo) error {
-		// Abort the scan early on interruption (SIGINT/SIGTERM). Returning here
-		// lets the deferred cleanup remove any temporary files created so far.
-		if err := ctx.Err(); err != nil {
-			return err
+	if err := g.Wait(); err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return fmt.Errorf("interrupted before applying changes: %w", err)
+		}
+
+		return err
+	}
+
+	t.reportBDDSuites()
+
+	// Do not begin the destructive rename phase if we were interrupted during
+	// the scan. The deferred cleanup removes the temporary files, leaving the
+	// original files untouched.
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("interrupted before applying changes: %w", err)
+	}
+
+	// Replace the original files with the temporary files if all writes are successful.
+	// The apply phase runs to completion without checking for cancellation so that the
+	// files are not left in a partially rewritten state.
+	pending, err := rewrites.stage()
+	if err != nil {
+		return err
+	}
+
+	if t.verifyCount > 0 {
+		if pending, err = t.verify(ctx, pending); err != nil {
+			return fmt.Errorf("interrupted before applying changes: %w", err)
 		}
+	}
+
+	return t.apply(pending)
+}
+
+// target is a test file to be processed.
+type target struct {
+	path string
+	// lineRanges are the changed lines of the file. nil means the whole file.
+	lineRanges []LineRange
+}
 
+// discover sends the test files under t.in to targets.
+func (t *tparagen) discover(ctx context.Context, targets chan<- target) error {
+	if err := walker.Walk(t.in, func(path string, info fs.FileInfo) error {
 		if info.IsDir() && t.skipDir(path) {
 			return filepath.SkipDir
 		}
@@ -86,87 +292,275 @@ func (t *tparagen) run(ctx context.Context) error {
 			return nil
 		}
 
-		if filepath.Ext(path) != ".go" {
+		if !isTestFile(path) {
 			return nil
 		}
 
-		if !strings.HasSuffix(filepath.Base(path), "_test.go") {
+		select {
+		case targets <- target{path: path}:
 			return nil
+		case <-ctx.Done():
+			return ctx.Err()
 		}
-
-		f, err := os.OpenFile(path, os.O_RDWR, 0664)
-		if err != nil {
-			return fmt.Errorf("cannot open %s. %w", path, err)
+	}); err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return err
 		}
-		defer f.Close()
 
-		tmpf, err := os.CreateTemp("", "temp_")
-		if err != nil {
-			return fmt.Errorf("failed to create temp file for %s. %w", path, err)
+		return fmt.Errorf("error occurred in walker.Walk(). %w", err)
+	}
+
+	return nil
+}
+
+// discoverChanged sends the test files under t.in changed according to git to targets.
+func (t *tparagen) discoverChanged(ctx context.Context, targets chan<- target) error {
+	// The paths git returns are under the repository root with the symbolic links resolved.
+	in, err := filepath.Abs(t.in)
+	if err == nil {
+		in, err = filepath.EvalSymlinks(in)
+	}
+
+	if err != nil {
+		return fmt.Errorf("cannot resolve %s. %w", t.in, err)
+	}
+
+	changes, err := gitChanges(ctx, in, t.since, t.staged)
+	if err != nil {
+		return err
+	}
+
+	paths := make([]string, 0, len(changes))
+	for p := range changes {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	for _, p := range paths {
+		rel, err := filepath.Rel(in, p)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
 		}
 
-		defer tmpf.Close()
+		if !isTestFile(rel) || t.skipPath(rel) {
+			continue
+		}
 
-		b, err := io.ReadAll(f)
-		if err != nil {
-			return fmt.Errorf("cannot read %s. %w", path, err)
+		select {
+		case targets <- target{path: filepath.Join(t.in, rel), lineRanges: changes[p]}:
+		case <-ctx.Done():
+			return ctx.Err()
 		}
+	}
+
+	return nil
+}
+
+func (t *tparagen) gitMode() bool {
+	return t.since != "" || t.staged
+}
+
+// process rewrites a test file and records the result in rewrites if it was changed.
+func (t *tparagen) process(target target, cache *resultCache, rewrites *rewriteStore) error {
+	path := target.path
 
-		got, err := GenerateTParallel(path, b, t.needFixLoopVar)
-		if err != nil {
-			return fmt.Errorf("error occurred in Process(). %w", err)
+	// The test files of the packages that must stay serial are left as is.
+	if p, err := t.serialPkgs.lookup(filepath.Dir(path)); err != nil || p != nil {
+		return err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("cannot stat %s. %w", path, err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("cannot read %s. %w", path, err)
+	}
+
+	opts, err := t.generateOptions(target)
+	if err != nil {
+		return err
+	}
+
+	if t.prompter != nil {
+		opts = append(opts, WithEditFilter(t.prompter.filter(path, b)))
+	}
+
+	var diags []Diagnostic
+	opts = append(opts, WithDiagnostics(func(d Diagnostic) {
+		diags = append(diags, d)
+	}))
+
+	var key string
+	if cache != nil {
+		var ok bool
+		if key, ok = cache.key(path, b, t.needFixLoopVar, newGenerateOptions(opts...)); !ok {
+			cache = nil
+		} else if cache.unchanged(key) {
+			return nil
 		}
+	}
 
-		if !bytes.Equal(b, got) {
-			if _, err := tmpf.WriteAt(got, 0); err != nil {
-				return fmt.Errorf("error occurred in writeAt(). %w", err)
-			}
-			tempFiles.Store(path, tmpf.Name())
+	got, err := GenerateTParallel(path, b, t.needFixLoopVar, opts...)
+	if err != nil {
+		return fmt.Errorf("error occurred in Process(). %w", err)
+	}
+
+	t.report(diags)
+
+	if bytes.Equal(b, got) {
+		// Files with findings are processed again so that the findings are reported on every run.
+		if len(diags) == 0 {
+			cache.markUnchanged(key)
 		}
 
 		return nil
-	}); err != nil {
-		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
-			return fmt.Errorf("interrupted before applying changes: %w", err)
+	}
+
+	return rewrites.add(path, info, got)
+}
+
+// generateOptions returns the options of GenerateTParallel for target.
+func (t *tparagen) generateOptions(target target) ([]GenerateOption, error) {
+	opts := append([]GenerateOption{}, t.genOpts...)
+	if t.changedFuncsOnly && target.lineRanges != nil {
+		opts = append(opts, WithLineRanges(target.lineRanges...))
+	}
+
+	files, err := t.packageFiles(target.path)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(opts, files...), nil
+}
+
+// report writes the findings to outStream.
+func (t *tparagen) report(diags []Diagnostic) {
+	if len(diags) == 0 {
+		return
+	}
+
+	t.reportMu.Lock()
+	defer t.reportMu.Unlock()
+
+	for _, d := range diags {
+		if d.Category == CategoryBDD {
+			t.bddSuites = append(t.bddSuites, d)
+
+			continue
 		}
 
-		return fmt.Errorf("error occurred in walker.Walk(). %w", err)
+		fmt.Fprintln(t.outStream, d.String())
+	}
+}
+
+// reportBDDSuites writes the findings about the tests bootstrapping BDD frameworks to outStream.
+func (t *tparagen) reportBDDSuites() {
+	if len(t.bddSuites) == 0 {
+		return
 	}
 
-	// Do not begin the destructive rename phase if we were interrupted during
-	// the scan. The deferred cleanup removes the temporary files, leaving the
-	// original files untouched.
-	if err := ctx.Err(); err != nil {
-		return fmt.Errorf("interrupted before applying changes: %w", err)
+	sort.Slice(t.bddSuites, func(i, j int) bool {
+		a, b := t.bddSuites[i].Pos, t.bddSuites[j].Pos
+		if a.Filename != b.Filename {
+			return a.Filename < b.Filename
+		}
+
+		return a.Offset < b.Offset
+	})
+
+	fmt.Fprintln(t.outStream, "BDD suites, run their specs in parallel with the framework's runner such as ginkgo -p:")
+
+	for _, d := range t.bddSuites {
+		fmt.Fprintln(t.outStream, "\t"+d.String())
 	}
+}
 
-	// Replace the original file with the temporary file if all writes are successful.
-	// This phase runs to completion without checking for cancellation so that the
-	// files are not left in a partially rewritten state.
-	tempFiles.Range(func(key, value any) bool {
-		origPath, ok := key.(string)
-		if !ok {
-			return false
+func (t *tparagen) workers() int {
+	if t.prompter != nil {
+		return 1
+	}
+
+	if t.jobs > 0 {
+		return t.jobs
+	}
+
+	return runtime.GOMAXPROCS(0)
+}
+
+// apply replaces each original file with its rewritten temporary file.
+// The originals are backed up before being replaced. If any replacement fails,
+// the files rewritten so far are restored from their backups, and the failure is
+// returned together with any errors that occurred while rolling back.
+func (t *tparagen) apply(pending map[string]string) error {
+	origPaths := make([]string, 0, len(pending))
+	for p := range pending {
+		origPaths = append(origPaths, p)
+	}
+	// Apply in a stable order so that failures are reproducible.
+	sort.Strings(origPaths)
+
+	// backups of the files replaced so far.
+	// key: original file path, value: backup file path
+	backups := make(map[string]string, len(origPaths))
+
+	for _, origPath := range origPaths {
+		backupPath := origPath + backupSuffix
+		if err := t.rename(origPath, backupPath); err != nil {
+			return errors.Join(
+				fmt.Errorf("failed to back up %s. %w", origPath, err),
+				t.rollback(backups),
+			)
 		}
 
-		tmpPath, ok := value.(string)
-		if !ok {
-			return false
+		if err := t.rename(pending[origPath], origPath); err != nil {
+			// The original is not replaced yet; put it back first.
+			backups[origPath] = backupPath
+
+			return errors.Join(
+				fmt.Errorf("failed to rename %s to %s. %w", pending[origPath], origPath, err),
+				t.rollback(backups),
+			)
 		}
 
-		if err := os.Rename(tmpPath, origPath); err != nil {
-			// TODO: logging
-			if _, err := fmt.Fprintf(t.errStream, "failed to rename %s to %s. %v\n", tmpPath, origPath, err); err != nil {
-				return false
+		backups[origPath] = backupPath
+	}
+
+	for _, backupPath := range backups {
+		if err := os.Remove(backupPath); err != nil {
+			if _, err := fmt.Fprintf(t.errStream, "failed to remove backup file %s. %v\n", backupPath, err); err != nil {
+				return err
 			}
 		}
-
-		return true
-	})
+	}
 
 	return nil
 }
 
+// rollback restores the original files from their backups.
+func (t *tparagen) rollback(backups map[string]string) error {
+	var errs []error
+
+	for origPath, backupPath := range backups {
+		if err := t.rename(backupPath, origPath); err != nil {
+			errs = append(errs, fmt.Errorf("failed to restore %s from %s. %w", origPath, backupPath, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (t *tparagen) rename(oldpath, newpath string) error {
+	if t.renameFunc != nil {
+		return t.renameFunc(oldpath, newpath)
+	}
+
+	return renameFile(oldpath, newpath)
+}
+
 func (t *tparagen) skipDir(p string) bool {
 	for _, dir := range t.ignoreDirs {
 		if filepath.Base(p) == dir {
@@ -176,3 +570,18 @@ func (t *tparagen) skipDir(p string) bool {
 
 	return false
 }
+
+// skipPath reports whether any directory of the relative file path p is ignored.
+func (t *tparagen) skipPath(p string) bool {
+	for dir := filepath.Dir(p); dir != "." && dir != string(filepath.Separator); dir = filepath.Dir(dir) {
+		if t.skipDir(dir) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isTestFile(p string) bool {
+	return filepath.Ext(p) == ".go" && strings.HasSuffix(filepath.Base(p), "_test.go")
+}
@@ -2,9 +2,12 @@ package tparagen
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -84,3 +87,326 @@ func TestRunLeavesFilesUntouchedWhenCanceled(t *testing.T) {
 		t.Fatalf("expected file to be untouched on cancellation.\norig:\n%s\ngot:\n%s", orig, got)
 	}
 }
+
+func TestRunRollsBackWhenRenameFails(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	paths := []string{filepath.Join(dir, "a_test.go"), filepath.Join(dir, "b_test.go")}
+	for _, p := range paths {
+		if err := os.WriteFile(p, []byte(rewritableTestSrc), 0o644); err != nil {
+			t.Fatalf("failed to write test file: %v", err)
+		}
+	}
+
+	r := newRunner(dir)
+	r.renameFunc = func(oldpath, newpath string) error {
+		// fail to replace the second file with its rewritten contents.
+		if newpath == paths[1] && !strings.HasSuffix(oldpath, backupSuffix) {
+			return errors.New("injected rename failure")
+		}
+
+		return os.Rename(oldpath, newpath)
+	}
+
+	if err := r.run(context.Background()); err == nil {
+		t.Fatal("expected an error when rename fails, got nil")
+	}
+
+	for _, p := range paths {
+		got, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatalf("failed to read file: %v", err)
+		}
+
+		if string(got) != rewritableTestSrc {
+			t.Fatalf("expected %s to be restored.\norig:\n%s\ngot:\n%s", p, rewritableTestSrc, got)
+		}
+
+		if _, err := os.Stat(p + backupSuffix); !os.IsNotExist(err) {
+			t.Fatalf("expected backup of %s to be removed, got err: %v", p, err)
+		}
+	}
+}
+
+func TestRunPreservesFileMode(t *testing.T) {
+	t.Parallel()
+
+	path, _ := setupTestModule(t)
+	if err := os.Chmod(path, 0o640); err != nil {
+		t.Fatalf("failed to chmod test file: %v", err)
+	}
+
+	if err := newRunner(filepath.Dir(path)).run(context.Background()); err != nil {
+		t.Fatalf("run() returned error: %v", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("failed to stat file: %v", err)
+	}
+
+	if got := info.Mode().Perm(); got != 0o640 {
+		t.Fatalf("expected mode 0640, got %o", got)
+	}
+
+	// Temporary and backup files are created next to the target and must not be left behind.
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatalf("failed to read dir: %v", err)
+	}
+
+	if len(entries) != 1 {
+		t.Fatalf("expected only the test file to remain, got %d entries", len(entries))
+	}
+}
+
+func TestRunWithWorkerPool(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	var paths []string
+	for _, name := range []string{"a_test.go", "b_test.go", "c_test.go", "d_test.go"} {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte(rewritableTestSrc), 0o644); err != nil {
+			t.Fatalf("failed to write test file: %v", err)
+		}
+		paths = append(paths, p)
+	}
+
+	r := newRunner(dir)
+	r.jobs = 2
+	// keep the first rewrites in memory and spill the rest to temporary files.
+	r.pendingMemoryLimit = int64(len(rewritableTestSrc)) * 3
+
+	if err := r.run(context.Background()); err != nil {
+		t.Fatalf("run() returned error: %v", err)
+	}
+
+	for _, p := range paths {
+		got, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatalf("failed to read file: %v", err)
+		}
+
+		if string(got) == rewritableTestSrc {
+			t.Fatalf("expected %s to be rewritten, but it was unchanged", p)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read dir: %v", err)
+	}
+
+	if len(entries) != len(paths) {
+		t.Fatalf("expected no temporary files to remain, got %d entries", len(entries))
+	}
+}
+
+func TestRunInteractive(t *testing.T) {
+	t.Parallel()
+
+	path, _ := setupTestModule(t)
+
+	var out strings.Builder
+
+	r := newRunner(filepath.Dir(path))
+	r.outStream = &out
+	// Subtests are asked about before their test function: accept the subtest and decline the main test.
+	WithInteractive(strings.NewReader("y\nn\n"))(r)
+
+	if err := r.run(context.Background()); err != nil {
+		t.Fatalf("run() returned error: %v", err)
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+
+	want := `package t
+
+import "testing"
+
+func TestFoo(t *testing.T) {
+	t.Run("1", func(t *testing.T) {
+		t.Parallel()
+	})
+}
+`
+	if string(got) != want {
+		t.Errorf("result:\n%s, want:\n%s", got, want)
+	}
+
+	if !strings.Contains(out.String(), "insert t.Parallel() into subtest \"1\" of TestFoo") {
+		t.Errorf("expected the subtest edit to be shown, got:\n%s", out.String())
+	}
+}
+
+func TestRunReportsBDDSuitesSeparately(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"b_test.go": `package t
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+)
+
+func TestB(t *testing.T) {
+	RunSpecs(t, "B")
+}
+`,
+		"a_test.go": `package t
+
+import (
+	"testing"
+
+	"github.com/onsi/gomega"
+)
+
+func TestA(t *testing.T) {
+	gomega.RegisterTestingT(t)
+}
+`,
+	}
+	for name, src := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0o644); err != nil {
+			t.Fatalf("failed to write test file: %v", err)
+		}
+	}
+
+	var out strings.Builder
+
+	r := newRunner(dir)
+	r.outStream = &out
+
+	if err := r.run(context.Background()); err != nil {
+		t.Fatalf("run() returned error: %v", err)
+	}
+
+	want := fmt.Sprintf(`BDD suites, run their specs in parallel with the framework's runner such as ginkgo -p:
+	%s:10:2: TestA bootstraps Gomega with RegisterTestingT, not parallelised
+	%s:10:2: TestB bootstraps Ginkgo with RunSpecs, not parallelised
+`, filepath.Join(dir, "a_test.go"), filepath.Join(dir, "b_test.go"))
+	if out.String() != want {
+		t.Errorf("result:\n%s, want:\n%s", out.String(), want)
+	}
+}
+
+func TestRunLeavesSerialPackagesUntouched(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"foo/a_test.go":    rewritableTestSrc,
+		"foo/b_test.go":    rewritableTestSrc,
+		"foo/main_test.go": testMainSrc,
+		"bar/bar_test.go":  rewritableTestSrc,
+	}
+	for name, src := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatalf("failed to create dir: %v", err)
+		}
+		if err := os.WriteFile(p, []byte(src), 0o644); err != nil {
+			t.Fatalf("failed to write test file: %v", err)
+		}
+	}
+
+	var out strings.Builder
+
+	r := newRunner(dir)
+	r.outStream = &out
+
+	if err := r.run(context.Background()); err != nil {
+		t.Fatalf("run() returned error: %v", err)
+	}
+
+	for name, src := range files {
+		got, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("failed to read file: %v", err)
+		}
+
+		if rewritten := string(got) != src; rewritten != (name == "bar/bar_test.go") {
+			t.Errorf("%s rewritten: %v", name, rewritten)
+		}
+	}
+
+	want := filepath.Join(dir, "foo", "main_test.go") + ":8:1: TestMain controls the tests of package foo, which may share its fixtures, not parallelised\n"
+	if out.String() != want {
+		t.Errorf("result:\n%s, want:\n%s", out.String(), want)
+	}
+}
+
+func TestRunAnalysesPackages(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"foo.go": `package foo
+
+var Counter int
+`,
+		"helpers_test.go": `package foo
+
+import "testing"
+
+func parallel(t *testing.T) {
+	t.Parallel()
+}
+
+func reset() {
+	Counter = 0
+}
+`,
+		"foo_test.go": `package foo
+
+import "testing"
+
+func TestHelper(t *testing.T) {
+	parallel(t)
+}
+
+func TestReset(t *testing.T) {
+	reset()
+}
+`,
+	}
+	for name, src := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0o644); err != nil {
+			t.Fatalf("failed to write test file: %v", err)
+		}
+	}
+
+	var out strings.Builder
+
+	r := newRunner(dir)
+	r.outStream = &out
+
+	if err := r.run(context.Background()); err != nil {
+		t.Fatalf("run() returned error: %v", err)
+	}
+
+	for name, src := range files {
+		got, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("failed to read file: %v", err)
+		}
+
+		if string(got) != src {
+			t.Errorf("%s rewritten:\n%s", name, got)
+		}
+	}
+
+	want := filepath.Join(dir, "helpers_test.go") + ":10:2: TestReset writes package-level variable Counter (via reset), not parallelised\n"
+	if out.String() != want {
+		t.Errorf("result:\n%s, want:\n%s", out.String(), want)
+	}
+}
@@ -0,0 +1,143 @@
+package tparagen
+
+import (
+	"go/ast"
+	"go/importer"
+	"go/token"
+	"go/types"
+	"path/filepath"
+	"sync"
+)
+
+// maxModuleImporters is the number of modules whose imported packages are kept in memory.
+// A run across more modules imports the packages of those used least recently again.
+const maxModuleImporters = 4
+
+// importers are the importers of the modules of the files type-checked.
+var importers moduleImporters
+
+// moduleImporters shares a moduleImporter between the files of each module, so that each
+// imported package is type-checked once per module.
+type moduleImporters struct {
+	mu sync.Mutex
+	// entries are the importers by module root, "" for the files outside modules.
+	entries map[string]*moduleImporter
+	// clock orders the uses of the entries.
+	clock int64
+}
+
+// moduleImporter type-checks the packages imported by the files of a module from source. The source
+// importer is not safe for concurrent use, so its imports are serialised, but not the type checks
+// of the files importing them.
+type moduleImporter struct {
+	mu  sync.Mutex
+	imp types.ImporterFrom
+	// fset holds the positions of the objects of the imported packages.
+	fset *token.FileSet
+	// helpers caches whether the functions of the imported packages are parallel helpers.
+	// key: *types.Func, value: the index of the parameter, or -1 if it is not a parallel helper.
+	helpers sync.Map
+	// used is the clock of the last use.
+	used int64
+}
+
+func (m *moduleImporter) Import(path string) (*types.Package, error) {
+	return m.ImportFrom(path, ".", 0)
+}
+
+// ImportFrom imports the package path as imported by the files of dir, which
+// the go command resolves from the module containing dir.
+func (m *moduleImporter) ImportFrom(path, dir string, mode types.ImportMode) (*types.Package, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.imp.ImportFrom(path, dir, mode)
+}
+
+// get returns the importer of the module containing dir. The importers used least
+// recently are dropped beyond maxModuleImporters.
+func (c *moduleImporters) get(dir string) *moduleImporter {
+	root, _ := moduleRoot(dir)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries == nil {
+		c.entries = map[string]*moduleImporter{}
+	}
+
+	m, ok := c.entries[root]
+	if !ok {
+		fset := token.NewFileSet()
+		imp, _ := importer.ForCompiler(fset, "source", nil).(types.ImporterFrom)
+		m = &moduleImporter{imp: imp, fset: fset}
+		c.entries[root] = m
+	}
+
+	c.clock++
+	m.used = c.clock
+
+	for len(c.entries) > maxModuleImporters {
+		oldestRoot := ""
+
+		var oldest *moduleImporter
+
+		for r, e := range c.entries {
+			if oldest == nil || e.used < oldest.used {
+				oldestRoot, oldest = r, e
+			}
+		}
+
+		delete(c.entries, oldestRoot)
+	}
+
+	return m
+}
+
+// typeCheck returns the type information of files, which belong to the same package, and the
+// importer of their imports. Type errors, such as references to the files of the package not given,
+// are ignored, so the information may be partial.
+func typeCheck(fs *token.FileSet, files []*ast.File) (*types.Info, *moduleImporter) {
+	info := &types.Info{
+		Types:      map[ast.Expr]types.TypeAndValue{},
+		Defs:       map[*ast.Ident]types.Object{},
+		Uses:       map[*ast.Ident]types.Object{},
+		Selections: map[*ast.SelectorExpr]*types.Selection{},
+	}
+
+	imp := importers.get(filepath.Dir(fs.Position(files[0].Pos()).Filename))
+
+	conf := types.Config{
+		Importer:    imp,
+		Error:       func(error) {},
+		FakeImportC: true,
+	}
+
+	_, _ = conf.Check(files[0].Name.Name, fs, files, info)
+
+	return info, imp
+}
+
+// calledFuncObj returns the function or method called by call according to info.
+func calledFuncObj(info *types.Info, call *ast.CallExpr) (*types.Func, bool) {
+	var id *ast.Ident
+
+	switch fun := ast.Unparen(call.Fun).(type) {
+	case *ast.Ident:
+		id = fun
+	case *ast.SelectorExpr:
+		if sel, ok := info.Selections[fun]; ok {
+			f, ok := sel.Obj().(*types.Func)
+
+			return f, ok
+		}
+
+		id = fun.Sel
+	default:
+		return nil, false
+	}
+
+	f, ok := info.Uses[id].(*types.Func)
+
+	return f, ok
+}
@@ -0,0 +1,43 @@
+package tparagen
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestModuleImportersKeepRecentModules(t *testing.T) {
+	t.Parallel()
+
+	roots := make([]string, maxModuleImporters+1)
+	for i := range roots {
+		roots[i] = t.TempDir()
+
+		if err := os.WriteFile(filepath.Join(roots[i], "go.mod"), []byte("module example.com/m\n"), 0o600); err != nil {
+			t.Fatalf("failed to write go.mod: %v", err)
+		}
+
+		if err := os.Mkdir(filepath.Join(roots[i], "pkg"), 0o755); err != nil {
+			t.Fatalf("failed to create dir: %v", err)
+		}
+	}
+
+	var c moduleImporters
+
+	first := c.get(filepath.Join(roots[0], "pkg"))
+	if c.get(roots[0]) != first {
+		t.Errorf("the directories of a module got different importers")
+	}
+
+	for _, root := range roots[1:] {
+		c.get(root)
+	}
+
+	if len(c.entries) != maxModuleImporters {
+		t.Errorf("kept %d importers, want %d", len(c.entries), maxModuleImporters)
+	}
+
+	if c.get(roots[0]) == first {
+		t.Errorf("the importer of the module used least recently was kept")
+	}
+}
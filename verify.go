@@ -0,0 +1,124 @@
+package tparagen
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// overlay is the format of the file given to the -overlay flag of the go command.
+type overlay struct {
+	Replace map[string]string
+}
+
+// verify runs the tests of each package containing rewritten files with the race
+// detector, using an overlay so that the original files are left untouched.
+// It returns the rewrites of the packages whose tests passed; the packages whose
+// tests failed are reported on errStream for manual attention.
+// pending maps the original file paths to the temporary file paths.
+func (t *tparagen) verify(ctx context.Context, pending map[string]string) (map[string]string, error) {
+	// key: package directory, value: original file paths
+	pkgs := map[string][]string{}
+	for origPath := range pending {
+		dir := filepath.Dir(origPath)
+		pkgs[dir] = append(pkgs[dir], origPath)
+	}
+
+	dirs := make([]string, 0, len(pkgs))
+	for dir := range pkgs {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	verified := map[string]string{}
+
+	for _, dir := range dirs {
+		out, err := t.testWithOverlay(ctx, dir, pkgs[dir], pending)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		if err != nil {
+			sort.Strings(pkgs[dir])
+			fmt.Fprintf(t.errStream, "verify: tests of %s failed with the rewrites, not applied to:\n", dir)
+			for _, p := range pkgs[dir] {
+				fmt.Fprintf(t.errStream, "\t%s\n", p)
+			}
+			fmt.Fprintf(t.errStream, "%s\n", bytes.TrimSpace(out))
+
+			continue
+		}
+
+		for _, p := range pkgs[dir] {
+			verified[p] = pending[p]
+		}
+	}
+
+	return verified, nil
+}
+
+// testWithOverlay runs go test in dir with the given rewritten files overlaid.
+// The combined output of go test is returned.
+func (t *tparagen) testWithOverlay(ctx context.Context, dir string, origPaths []string, pending map[string]string) ([]byte, error) {
+	ov := overlay{Replace: map[string]string{}}
+	for _, p := range origPaths {
+		from, err := filepath.Abs(p)
+		if err != nil {
+			return nil, err
+		}
+
+		to, err := filepath.Abs(pending[p])
+		if err != nil {
+			return nil, err
+		}
+
+		ov.Replace[from] = to
+	}
+
+	return goTestWithOverlay(ctx, dir, ov, t.verifyArgs()...)
+}
+
+func (t *tparagen) verifyArgs() []string {
+	args := []string{"-count=" + strconv.Itoa(max(t.verifyCount, 1))}
+	if !t.verifyNoRace {
+		args = append(args, "-race")
+	}
+
+	return args
+}
+
+// goTestWithOverlay runs go test for the package in dir with ov as the overlay.
+// The combined output of go test is returned.
+func goTestWithOverlay(ctx context.Context, dir string, ov overlay, args ...string) ([]byte, error) {
+	b, err := json.Marshal(ov)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.CreateTemp("", "tparagen-overlay-*.json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create overlay file. %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+
+		return nil, fmt.Errorf("failed to write overlay file. %w", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write overlay file. %w", err)
+	}
+
+	cmd := exec.CommandContext(ctx, "go", append(append([]string{"test", "-overlay=" + f.Name()}, args...), ".")...)
+	cmd.Dir = dir
+
+	return cmd.CombinedOutput()
+}
@@ -0,0 +1,82 @@
+package tparagen
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// serialOnlyTestSrc is a test that fails once its subtest runs in parallel,
+// because a parallel subtest only runs after its parent returns.
+const serialOnlyTestSrc = `package bad
+
+import "testing"
+
+func TestSerial(t *testing.T) {
+	returned := false
+	t.Run("1", func(t *testing.T) {
+		if returned {
+			t.Error("subtest ran after its parent returned")
+		}
+	})
+	returned = true
+}
+`
+
+func TestRunVerify(t *testing.T) {
+	t.Parallel()
+
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command is not available")
+	}
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"go.mod":            "module example.com/m\n\ngo 1.22\n",
+		"good/good_test.go": strings.ReplaceAll(rewritableTestSrc, "package t", "package good"),
+		"bad/bad_test.go":   serialOnlyTestSrc,
+	}
+	for name, src := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatalf("failed to create dir: %v", err)
+		}
+		if err := os.WriteFile(p, []byte(src), 0o644); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+	}
+
+	var errOut strings.Builder
+
+	r := newRunner(dir)
+	r.errStream = &errOut
+	r.verifyCount = 1
+	r.verifyNoRace = true
+
+	if err := r.run(context.Background()); err != nil {
+		t.Fatalf("run() returned error: %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(dir, "good/good_test.go"))
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+	if !strings.Contains(string(got), "t.Parallel()") {
+		t.Errorf("expected the rewrite of the passing package to be applied, got:\n%s", got)
+	}
+
+	got, err = os.ReadFile(filepath.Join(dir, "bad/bad_test.go"))
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+	if string(got) != serialOnlyTestSrc {
+		t.Errorf("expected the rewrite of the failing package not to be applied, got:\n%s", got)
+	}
+
+	if !strings.Contains(errOut.String(), filepath.Join(dir, "bad")) {
+		t.Errorf("expected the failing package to be reported, got:\n%s", errOut.String())
+	}
+}